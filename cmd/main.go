@@ -2,7 +2,14 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
 	"log/slog"
+	"ob-manager/internal/auth"
+	"ob-manager/internal/certs"
+	"ob-manager/internal/config"
+	"ob-manager/internal/lifecycle"
+	"ob-manager/internal/metrics"
 	"ob-manager/internal/processors"
 	"ob-manager/internal/subscriptions"
 	"ob-manager/internal/upstream/binance"
@@ -14,69 +21,168 @@ import (
 
 	inqueues "ob-manager/internal/queues/in"
 	outqueues "ob-manager/internal/queues/out"
+
+	"golang.org/x/sync/errgroup"
 )
 
 func main() {
 	slog.Info("Starting Binance Distributor Service")
 
+	if err := run(); err != nil {
+		slog.Error("OrderBook Distributor Service Failed", "Error", err)
+		os.Exit(1)
+	}
+
+	slog.Info("Exiting OrderBook Distributor Service")
+}
+
+// run starts the components and supervises them until a shutdown signal or the failure of a component,
+// then shuts them down in order. It returns the error of the failed component.
+func run() error {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("loading configurations: %w", err)
+	}
+
+	authenticator, err := auth.New(cfg.Auth)
+	if err != nil {
+		return fmt.Errorf("loading the authentication: %w", err)
+	}
+
+	reloader, err := loadTLS(cfg.TLS)
+	if err != nil {
+		return fmt.Errorf("loading the TLS certificates: %w", err)
+	}
+
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
 	// in queues manager
-	inQueue := inqueues.NewQManager()
+	inQueue := inqueues.NewQManager(cfg.InQueue)
+
+	// out queue sharded by currency pair
+	outQueue := outqueues.NewQueue(cfg.OutQueue, cfg.OutQueueShards)
 
-	// out queue manager
-	outQueue := outqueues.NewQueue()
+	// expose the queue occupancy
+	metrics.RegisterQueues(inQueue, outQueue)
 
 	// order book processes Manager
-	procManager := processors.NewManager(inQueue, outQueue)
+	procManager := processors.NewManager(inQueue, outQueue, processors.StaleThresholds{
+		StaleAfter:  cfg.StaleAfter,
+		MaxEventLag: cfg.MaxEventLag,
+	}, processors.AnalyticsSettings{
+		Interval:       cfg.Analytics.Interval,
+		ImbalanceDepth: cfg.Analytics.ImbalanceDepth,
+		DepthBands:     cfg.Analytics.DepthBands,
+	})
 
 	// initialize downstream subscribers store
-	subManager := subscriptions.NewManager(outQueue, procManager)
+	subManager := subscriptions.NewManager(outQueue, procManager, cfg.SendBuffer)
 
-	// start upstream client and connect to the market data provider
-	initUpstreamClient(ctx, inQueue, procManager)
+	// upstream client of the market data provider
+	client := initUpstreamClient(cfg, inQueue, procManager)
 
-	// start a downstream server
-	server := startDownstreamServer(subManager)
+	// downstream server
+	server := initDownstreamServer(cfg, subManager, procManager, client, authenticator, reloader)
 
-	gracefulShutdown(ctx, server)
+	g, gctx := errgroup.WithContext(ctx)
 
-	slog.Info("Exiting OrderBook Distributor Service")
+	steps := shutdownSteps{
+		conflation: lifecycle.Start(g, "out-queue conflation", outQueue),
+		push:       lifecycle.Start(g, "push handler", subManager),
+		processors: lifecycle.Start(g, "processors", procManager),
+		upstream:   lifecycle.Start(g, "upstream client", client),
+		server:     lifecycle.Start(g, "websocket server", server),
+		subs:       subManager,
+		inQueue:    inQueue,
+		outQueue:   outQueue,
+	}
+
+	if reloader != nil {
+		steps.certificates = lifecycle.Start(g, "certificates", reloader)
+	}
+
+	g.Go(func() error {
+		gracefulShutdown(gctx, steps, cfg.DrainTimeout)
+
+		return nil
+	})
+
+	return g.Wait()
 }
 
-func initUpstreamClient(ctx context.Context, queue *inqueues.InQManager, proc *processors.Manager) *binance.Client {
+func initUpstreamClient(cfg *config.Config, queue *inqueues.InQManager, proc *processors.Manager) *binance.Client {
 	slog.Info("Initializing Binance Client")
 
 	requests := make(chan []byte)
-	client := binance.NewClient(requests, queue, proc)
-	client.StartClient(ctx)
 
-	return client
+	return binance.NewClient(requests, queue, proc, cfg.Symbols)
 }
 
-// start websocket server.
-func startDownstreamServer(sub *subscriptions.Manager) *wsserver.WSServer {
-	return wsserver.NewWSServer(sub)
+// loadTLS returns the reloader of the certificates of the downstream server. It is nil without a certificate,
+// as the server is plain HTTP.
+func loadTLS(settings config.TLS) (*certs.Reloader, error) {
+	if !settings.Enabled() {
+		return nil, nil
+	}
+
+	return certs.NewReloader(settings)
 }
 
-// handle a graceful shutdown.
-func gracefulShutdown(ctx context.Context, server *wsserver.WSServer) {
+// create websocket server.
+func initDownstreamServer(cfg *config.Config, sub *subscriptions.Manager, proc *processors.Manager,
+	client *binance.Client, authenticator auth.Authenticator, reloader *certs.Reloader) *wsserver.WSServer {
+	var tlsConfig *tls.Config
+	if reloader != nil {
+		tlsConfig = reloader.TLSConfig()
+	}
+
+	return wsserver.NewWSServer(cfg, sub, proc, client, authenticator, tlsConfig)
+}
+
+// shutdownSteps are the services stopped by the graceful shutdown, in order.
+type shutdownSteps struct {
+	server       *lifecycle.Service
+	upstream     *lifecycle.Service
+	processors   *lifecycle.Service
+	push         *lifecycle.Service
+	conflation   *lifecycle.Service
+	certificates *lifecycle.Service
+
+	subs     *subscriptions.Manager
+	inQueue  *inqueues.InQManager
+	outQueue *outqueues.Queue
+}
+
+// handle a graceful shutdown, on a shutdown signal or the failure of a service. The server stops accepting
+// connections, the subscribers get their buffered messages and a going away message, the upstream streams are
+// unsubscribed, then the processors and the push handler are stopped. The messages dropped on the way are reported.
+func gracefulShutdown(ctx context.Context, steps shutdownSteps, drainTimeout time.Duration) {
 	slog.Info("Graceful Shutdown is monitoring")
 
 	<-ctx.Done()
 
-	slog.Info("Shutdown Signal Received")
+	slog.Info("Shutting Down", "Cause", context.Cause(ctx))
 
-	timeDuration := 30 * time.Second
-	ctx, cancel := context.WithTimeout(ctx, timeDuration)
+	steps.server.Stop()
 
-	defer cancel()
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), drainTimeout)
+	users, droppedMessages := steps.subs.Drain(drainCtx)
 
-	err := server.ShutDown(ctx)
-	if err != nil {
-		slog.Error("Error in closing web socket server: ", "Error", err)
+	cancelDrain()
+
+	steps.upstream.Stop()
+	steps.processors.Stop()
+	steps.push.Stop()
+	steps.conflation.Stop()
+
+	steps.certificates.Stop()
+
+	var droppedEvents int
+	for _, length := range steps.inQueue.Lengths() {
+		droppedEvents += length
 	}
 
-	slog.Info("Server Exited Gracefully")
+	slog.Info("Server Exited Gracefully", "Subscribers", users, "DroppedMessages", droppedMessages,
+		"DroppedOutQueue", steps.outQueue.Length(), "DroppedEvents", droppedEvents)
 }
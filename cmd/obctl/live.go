@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"ob-manager/pkg/client"
+	"ob-manager/pkg/protocol"
+)
+
+// clearScreen moves the cursor home and clears the terminal before a redraw.
+const clearScreen = "\033[H\033[2J"
+
+// bookCommand draws the ladder of the best levels of a currency pair, redrawn as the book changes.
+func bookCommand(ctx context.Context, s *server, args []string) error {
+	flags := flag.NewFlagSet("book", flag.ContinueOnError)
+	depth := flags.Int("depth", 20, "levels shown on each side")
+	group := flags.Float64("group", 0, "aggregate the book to price buckets of the given step")
+	refresh := flags.Duration("refresh", 200*time.Millisecond, "interval between the redraws")
+
+	symbol, err := symbolArg(flags, args)
+	if err != nil {
+		return err
+	}
+
+	c, err := s.client()
+	if err != nil {
+		return err
+	}
+
+	sub, err := c.SubscribeFunc(symbol, client.StreamDepth, client.Options{Depth: *depth, Group: *group},
+		func(client.Update) {})
+	if err != nil {
+		return err
+	}
+
+	return runClient(ctx, c, func(ctx context.Context) error {
+		return redraw(ctx, *refresh, func(w io.Writer) {
+			writeLadder(w, sub.Book(), *depth, c.Connected())
+		})
+	})
+}
+
+// writeLadder writes the asks from the worst to the best one above the bids from the best to the worst one,
+// with the cumulative quantity of each side.
+func writeLadder(w io.Writer, book *client.Book, depth int, connected bool) {
+	// the state of the book is published when it changes, so it is unknown until then
+	state := "synced"
+
+	switch {
+	case !connected:
+		state = "connecting"
+	case !book.Synced():
+		state = "waiting for snapshot"
+	case book.State() != "":
+		state = string(book.State())
+	}
+
+	fmt.Fprintf(w, "%s  %s  last update id %d  %s\n\n", book.Symbol(), state, book.LastUpdateId(),
+		time.Now().Format(time.TimeOnly))
+	fmt.Fprintf(w, "%-4s %16s %16s %16s\n", "", "PRICE", "QTY", "TOTAL")
+
+	asks := book.Asks(depth)
+	totals := make([]float64, len(asks))
+
+	var total float64
+
+	for i, level := range asks {
+		total += level.Qty
+		totals[i] = total
+	}
+
+	for i := len(asks) - 1; i >= 0; i-- {
+		fmt.Fprintf(w, "%-4s %16s %16s %16s\n", "ask", formatFloat(asks[i].Price), formatFloat(asks[i].Qty),
+			formatFloat(totals[i]))
+	}
+
+	if bid, ask, ok := book.BBO(); ok {
+		spread := ask.Price - bid.Price
+		mid := (ask.Price + bid.Price) / 2
+		fmt.Fprintf(w, "---- spread %s (%.2f bps) ----\n", formatFloat(spread), spread/mid*10000)
+	} else {
+		fmt.Fprintln(w, "----")
+	}
+
+	total = 0
+
+	for _, level := range book.Bids(depth) {
+		total += level.Qty
+		fmt.Fprintf(w, "%-4s %16s %16s %16s\n", "bid", formatFloat(level.Price), formatFloat(level.Qty),
+			formatFloat(total))
+	}
+}
+
+// bboCommand draws the best bid and ask of the currency pairs, of all the currency pairs served by default.
+func bboCommand(ctx context.Context, s *server, args []string) error {
+	flags := flag.NewFlagSet("bbo", flag.ContinueOnError)
+	refresh := flags.Duration("refresh", 200*time.Millisecond, "interval between the redraws")
+
+	symbols, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+
+	if len(symbols) == 0 {
+		if symbols, err = s.symbols(ctx); err != nil {
+			return err
+		}
+	}
+
+	c, err := s.client()
+	if err != nil {
+		return err
+	}
+
+	var (
+		mu     sync.Mutex
+		latest = make(map[string]*bboState)
+	)
+
+	for i, symbol := range symbols {
+		symbols[i] = strings.ToUpper(symbol)
+		state := &bboState{}
+		latest[symbols[i]] = state
+
+		_, err := c.SubscribeFunc(symbol, client.StreamBBO, client.Options{}, func(update client.Update) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			state.update(update)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return runClient(ctx, c, func(ctx context.Context) error {
+		return redraw(ctx, *refresh, func(w io.Writer) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			writeBBOs(w, symbols, latest, c.Connected())
+		})
+	})
+}
+
+// bboState is the latest best bid and ask of a currency pair and the state of its book.
+type bboState struct {
+	bbo     *protocol.BBO
+	state   protocol.BookState
+	updated time.Time
+}
+
+func (b *bboState) update(update client.Update) {
+	switch update.Type {
+	case protocol.TypeBBO:
+		if bbo, err := update.BBO(); err == nil {
+			b.bbo = bbo
+			b.updated = time.UnixMilli(update.Ts)
+		}
+	case protocol.TypeStatus:
+		if status, err := update.Status(); err == nil {
+			b.state = status.State
+		}
+	case protocol.TypeResync:
+		b.bbo = nil
+	}
+}
+
+func writeBBOs(w io.Writer, symbols []string, latest map[string]*bboState, connected bool) {
+	if !connected {
+		fmt.Fprintln(w, "connecting")
+	}
+
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(table, "SYMBOL\tBID QTY\tBID\tASK\tASK QTY\tSPREAD BPS\tSTATE\tUPDATED\t")
+
+	for _, symbol := range symbols {
+		b := latest[symbol]
+
+		state := string(b.state)
+		if state == "" {
+			state = "-"
+		}
+
+		if b.bbo == nil {
+			fmt.Fprintf(table, "%s\t-\t-\t-\t-\t-\t%s\t-\t\n", symbol, state)
+
+			continue
+		}
+
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n", symbol, b.bbo.BidQty, b.bbo.BidPrice, b.bbo.AskPrice,
+			b.bbo.AskQty, spreadBps(b.bbo), state, b.updated.Format("15:04:05.000"))
+	}
+
+	_ = table.Flush()
+}
+
+func spreadBps(bbo *protocol.BBO) string {
+	bid, bidErr := strconv.ParseFloat(bbo.BidPrice, 64)
+	ask, askErr := strconv.ParseFloat(bbo.AskPrice, 64)
+
+	if bidErr != nil || askErr != nil || bid+ask == 0 {
+		return "-"
+	}
+
+	return strconv.FormatFloat((ask-bid)/((ask+bid)/2)*10000, 'f', 2, 64)
+}
+
+// tailCommand prints the messages of a stream of a currency pair as they arrive.
+func tailCommand(ctx context.Context, s *server, args []string) error {
+	flags := flag.NewFlagSet("tail", flag.ContinueOnError)
+	stream := flags.String("stream", string(client.StreamDepth), "stream to print: depth, bbo or analytics")
+	asJSON := flags.Bool("json", false, "print the raw JSON messages, one per line")
+
+	symbol, err := symbolArg(flags, args)
+	if err != nil {
+		return err
+	}
+
+	c, err := s.client()
+	if err != nil {
+		return err
+	}
+
+	sub, err := c.Subscribe(symbol, client.Stream(*stream), client.Options{})
+	if err != nil {
+		return err
+	}
+
+	return runClient(ctx, c, func(context.Context) error {
+		encoder := json.NewEncoder(os.Stdout)
+
+		// the channel is closed when the client stops
+		for update := range sub.C() {
+			if *asJSON {
+				if err := encoder.Encode(update.Envelope); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			fmt.Println(describe(update.Envelope))
+		}
+
+		if errors.Is(sub.Err(), client.ErrSlowConsumer) {
+			return sub.Err()
+		}
+
+		return nil
+	})
+}
+
+// describe summarizes a message on one line.
+func describe(envelope *protocol.Envelope) string {
+	line := fmt.Sprintf("%s %-9s seq=%d prevSeq=%d", time.UnixMilli(envelope.Ts).Format("15:04:05.000"),
+		envelope.Type, envelope.Seq, envelope.PrevSeq)
+
+	var details string
+
+	switch envelope.Type {
+	case protocol.TypeSnapshot:
+		if snapshot, err := envelope.Snapshot(); err == nil {
+			details = fmt.Sprintf("bids=%d asks=%d", len(snapshot.Bids), len(snapshot.Asks))
+		}
+	case protocol.TypeDelta:
+		if delta, err := envelope.Delta(); err == nil {
+			details = fmt.Sprintf("updates=%d..%d bids=%v asks=%v", delta.FirstUpdateId, delta.FinalUpdateId,
+				delta.Bids, delta.Asks)
+		}
+	case protocol.TypeBBO:
+		if bbo, err := envelope.BBO(); err == nil {
+			details = fmt.Sprintf("bid=%s@%s ask=%s@%s", bbo.BidQty, bbo.BidPrice, bbo.AskQty, bbo.AskPrice)
+		}
+	case protocol.TypeAnalytics:
+		if analytics, err := envelope.Analytics(); err == nil {
+			details = fmt.Sprintf("mid=%s spreadBps=%.2f microprice=%s imbalance=%.3f",
+				formatFloat(analytics.Mid), analytics.SpreadBps, formatFloat(analytics.Microprice), analytics.Imbalance)
+		}
+	case protocol.TypeStatus:
+		if status, err := envelope.Status(); err == nil {
+			details = "state=" + string(status.State)
+		}
+	case protocol.TypeResync:
+		if resync, err := envelope.Resync(); err == nil {
+			details = "reason=" + resync.Reason
+		}
+	}
+
+	if details == "" {
+		return line
+	}
+
+	return line + " " + details
+}
+
+// runClient runs the client while display runs, until the context is done or the client fails.
+// It returns the error of the client or else of display.
+func runClient(ctx context.Context, c *client.Client, display func(ctx context.Context) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	runErr := make(chan error, 1)
+
+	go func() {
+		runErr <- c.Run(ctx)
+
+		cancel()
+	}()
+
+	err := display(ctx)
+
+	cancel()
+
+	if clientErr := <-runErr; clientErr != nil {
+		return clientErr
+	}
+
+	return err
+}
+
+// redraw clears the terminal and draws the screen at each interval until the context is done.
+func redraw(ctx context.Context, interval time.Duration, draw func(w io.Writer)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var screen bytes.Buffer
+
+	for {
+		screen.Reset()
+		screen.WriteString(clearScreen)
+		draw(&screen)
+
+		if _, err := os.Stdout.Write(screen.Bytes()); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
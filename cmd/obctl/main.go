@@ -0,0 +1,182 @@
+// Command obctl inspects the order books of a running OBManager server from a terminal:
+//
+//	obctl symbols
+//	obctl status
+//	obctl book BTCUSDT --depth 20
+//	obctl bbo
+//	obctl tail BTCUSDT --stream bbo --json
+//
+// The symbols and the status are read from the REST API and the live commands subscribe over the websocket.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+const usage = `usage: obctl [flags] <command> [arguments]
+
+commands:
+  symbols                 list the currency pairs served
+  status                  show the upstream state and the state of each book
+  book SYMBOL             live order book ladder
+  bbo [SYMBOL...]         live best bid and ask, of all the currency pairs by default
+  tail SYMBOL             print the messages of a stream as they arrive
+
+Run obctl <command> -h for the flags of a command.
+
+flags:
+`
+
+// command runs a subcommand with its arguments.
+type command func(ctx context.Context, server *server, args []string) error
+
+var commands = map[string]command{
+	"symbols": symbolsCommand,
+	"status":  statusCommand,
+	"book":    bookCommand,
+	"bbo":     bboCommand,
+	"tail":    tailCommand,
+}
+
+func main() {
+	global := flag.NewFlagSet("obctl", flag.ExitOnError)
+	address := global.String("server", envOr("OBCTL_SERVER", "localhost:8080"), "host:port of the server ($OBCTL_SERVER)")
+	useTLS := global.Bool("tls", false, "connect with TLS (wss:// and https://)")
+	caFile := global.String("ca", "", "CA certificates verifying the server, instead of the system ones")
+	certFile := global.String("cert", "", "client certificate of the mtls authentication")
+	keyFile := global.String("key", "", "key of the client certificate")
+	apiKey := global.String("api-key", os.Getenv("OBCTL_API_KEY"), "API key of the apikey authentication ($OBCTL_API_KEY)")
+	token := global.String("token", os.Getenv("OBCTL_TOKEN"), "bearer token of the hmac and jwt authentications ($OBCTL_TOKEN)")
+
+	global.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		global.PrintDefaults()
+	}
+
+	_ = global.Parse(os.Args[1:])
+
+	if global.NArg() == 0 {
+		global.Usage()
+		os.Exit(2)
+	}
+
+	run, ok := commands[global.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", global.Arg(0))
+		global.Usage()
+		os.Exit(2)
+	}
+
+	// the live commands redraw the terminal, so only the failures are logged
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError})))
+
+	var tlsConfig *tls.Config
+
+	if *useTLS || *caFile != "" || *certFile != "" {
+		config, err := loadTLS(*caFile, *certFile, *keyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "obctl: %v\n", err)
+			os.Exit(1)
+		}
+
+		tlsConfig = config
+	}
+
+	srv := &server{
+		address:   *address,
+		tlsConfig: tlsConfig,
+		apiKey:    *apiKey,
+		token:     *token,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, srv, global.Args()[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(2)
+		}
+
+		fmt.Fprintf(os.Stderr, "obctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// loadTLS returns the TLS configuration of the connections, with the client certificate if set.
+func loadTLS(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading the CA certificates: %w", err)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", caFile)
+		}
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading the client certificate: %w", err)
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// parseArgs parses the flags of a command, which may follow its positional arguments as in
+// "book BTCUSDT --depth 20", and returns the positional arguments.
+func parseArgs(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+
+		if flags.NArg() == 0 {
+			return positional, nil
+		}
+
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
+
+// symbolArg returns the currency pair of the commands taking exactly one.
+func symbolArg(flags *flag.FlagSet, args []string) (string, error) {
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return "", err
+	}
+
+	if len(positional) != 1 {
+		return "", fmt.Errorf("usage: obctl %s SYMBOL [flags]", flags.Name())
+	}
+
+	return strings.ToUpper(positional[0]), nil
+}
+
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+
+	return fallback
+}
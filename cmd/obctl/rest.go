@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"ob-manager/pkg/client"
+	"ob-manager/pkg/protocol"
+)
+
+// requestTimeout is the maximum time of a REST request.
+const requestTimeout = 10 * time.Second
+
+// server is the address and the credentials of the OBManager server.
+type server struct {
+	address   string
+	tlsConfig *tls.Config
+	apiKey    string
+	token     string
+}
+
+func (s *server) httpURL(path string) string {
+	if s.tlsConfig != nil {
+		return "https://" + s.address + path
+	}
+
+	return "http://" + s.address + path
+}
+
+func (s *server) wsURL() string {
+	if s.tlsConfig != nil {
+		return "wss://" + s.address + "/ws"
+	}
+
+	return "ws://" + s.address + "/ws"
+}
+
+// client returns the websocket client of the server. It connects when Run is called.
+func (s *server) client() (*client.Client, error) {
+	return client.New(client.Config{
+		URL:       s.wsURL(),
+		APIKey:    s.apiKey,
+		Token:     s.token,
+		TLSConfig: s.tlsConfig,
+		OnError: func(message *protocol.ErrorMessage) {
+			fmt.Fprintf(os.Stderr, "server error: %s: %s\n", message.Code, message.Message)
+		},
+	})
+}
+
+// get decodes the JSON response of a REST endpoint into body. The error responses are returned as errors.
+func (s *server) get(ctx context.Context, path string, body any) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.httpURL(path), nil)
+	if err != nil {
+		return err
+	}
+
+	// the REST API authenticates the clients like the websocket
+	if s.apiKey != "" {
+		req.Header.Set("X-API-Key", s.apiKey)
+	}
+
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: s.tlsConfig}}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var message protocol.ErrorMessage
+		if json.Unmarshal(data, &message) == nil && message.Code != "" {
+			return fmt.Errorf("%s: %s: %s", path, message.Code, message.Message)
+		}
+
+		return fmt.Errorf("%s: %s", path, resp.Status)
+	}
+
+	return json.Unmarshal(data, body)
+}
+
+// symbols returns the currency pairs served.
+func (s *server) symbols(ctx context.Context) ([]string, error) {
+	var response struct {
+		Symbols []string `json:"symbols"`
+	}
+
+	if err := s.get(ctx, "/api/v1/symbols", &response); err != nil {
+		return nil, err
+	}
+
+	return response.Symbols, nil
+}
+
+// symbolsCommand lists the currency pairs served.
+func symbolsCommand(ctx context.Context, s *server, args []string) error {
+	flags := flag.NewFlagSet("symbols", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print the JSON response")
+
+	if _, err := parseArgs(flags, args); err != nil {
+		return err
+	}
+
+	symbols, err := s.symbols(ctx)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return json.NewEncoder(os.Stdout).Encode(symbols)
+	}
+
+	for _, symbol := range symbols {
+		fmt.Println(symbol)
+	}
+
+	return nil
+}
+
+// statusCommand prints the upstream state and the state of each book.
+func statusCommand(ctx context.Context, s *server, args []string) error {
+	flags := flag.NewFlagSet("status", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print the JSON response")
+
+	if _, err := parseArgs(flags, args); err != nil {
+		return err
+	}
+
+	var status protocol.ServiceStatus
+	if err := s.get(ctx, "/status", &status); err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return json.NewEncoder(os.Stdout).Encode(status)
+	}
+
+	fmt.Printf("ready: %t  upstream connected: %t\n\n", status.Ready, status.UpstreamConnected)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SYMBOL\tSTATE\tLAST UPDATE ID\tLAST EVENT AGE\tSUBSCRIBERS")
+
+	for _, symbol := range status.Symbols {
+		age := "-"
+		if symbol.LastEventAgeMs >= 0 {
+			age = (time.Duration(symbol.LastEventAgeMs) * time.Millisecond).String()
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%d\n", symbol.Symbol, symbol.State, symbol.LastUpdateId, age,
+			symbol.Subscribers)
+	}
+
+	return w.Flush()
+}
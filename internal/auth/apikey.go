@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// APIKey is an entry of the API keys file.
+type APIKey struct {
+	Key     string `json:"key"`
+	Subject string `json:"subject"`
+	Entitlements
+}
+
+// APIKeys authenticates the clients with static API keys loaded from a JSON file:
+//
+//	{"keys": [{"key": "...", "subject": "desk-a", "symbols": ["BTCUSDT"], "streams": ["bbo"]}]}
+type APIKeys struct {
+	// the keys are indexed by their hash, so that the lookup does not compare the secrets
+	keys map[[sha256.Size]byte]*Identity
+}
+
+func NewAPIKeys(path string) (*APIKeys, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading API keys: %w", err)
+	}
+
+	var file struct {
+		Keys []APIKey `json:"keys"`
+	}
+
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, fmt.Errorf("parsing API keys %s: %w", path, err)
+	}
+
+	a := &APIKeys{
+		keys: make(map[[sha256.Size]byte]*Identity, len(file.Keys)),
+	}
+
+	for i, k := range file.Keys {
+		if k.Key == "" || k.Subject == "" {
+			return nil, fmt.Errorf("API key %d of %s has no key or subject", i, path)
+		}
+
+		a.keys[sha256.Sum256([]byte(k.Key))] = &Identity{Subject: k.Subject, Entitlements: k.Entitlements}
+	}
+
+	return a, nil
+}
+
+func (a *APIKeys) Authenticate(r *http.Request) (*Identity, error) {
+	key, err := credential(r)
+	if err != nil {
+		return nil, err
+	}
+
+	identity, ok := a.keys[sha256.Sum256([]byte(key))]
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+
+	return identity, nil
+}
@@ -0,0 +1,107 @@
+// Package auth authenticates the downstream clients and checks their entitlements.
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"ob-manager/internal/config"
+	"slices"
+	"strings"
+)
+
+// Authentication modes.
+const (
+	ModeNone   = "none"
+	ModeAPIKey = "apikey"
+	ModeHMAC   = "hmac"
+	ModeJWT    = "jwt"
+	ModeMTLS   = "mtls"
+)
+
+const (
+	tokenParam   = "token"
+	bearerPrefix = "Bearer "
+	apiKeyHeader = "X-API-Key"
+	wildcard     = "*"
+
+	// AnonymousSubject is the subject of the clients when the authentication is disabled.
+	AnonymousSubject = "anonymous"
+)
+
+var (
+	ErrMissingCredentials = errors.New("missing credentials")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Identity of an authenticated client.
+type Identity struct {
+	Subject      string
+	Entitlements Entitlements
+}
+
+// Entitlements restrict the currency pairs and the streams a client may subscribe to.
+// An empty list or "*" allows all of them.
+type Entitlements struct {
+	Symbols []string `json:"symbols"`
+	Streams []string `json:"streams"`
+}
+
+// Allows reports whether the entitlements allow the stream of the currency pair.
+func (e Entitlements) Allows(symbol, stream string) bool {
+	return allows(e.Symbols, strings.ToUpper(symbol)) && allows(e.Streams, stream)
+}
+
+func allows(list []string, value string) bool {
+	return len(list) == 0 || slices.Contains(list, wildcard) || slices.ContainsFunc(list, func(item string) bool {
+		return strings.EqualFold(item, value)
+	})
+}
+
+// Authenticator authenticates the websocket upgrade requests.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// New returns the authenticator of the configured mode.
+func New(cfg config.Auth) (Authenticator, error) {
+	switch cfg.Mode {
+	case ModeNone:
+		return anonymous{}, nil
+	case ModeAPIKey:
+		return NewAPIKeys(cfg.KeysFile)
+	case ModeHMAC:
+		return NewHMACTokens(cfg.HMACSecret, cfg.Issuer, cfg.Audience)
+	case ModeJWT:
+		return NewJWKSTokens(cfg.JWKSFile, cfg.Issuer, cfg.Audience)
+	case ModeMTLS:
+		return NewClientCerts(cfg.SubjectsFile)
+	default:
+		return nil, fmt.Errorf("unknown authentication mode %q", cfg.Mode)
+	}
+}
+
+// anonymous accepts all the clients with all the entitlements.
+type anonymous struct{}
+
+func (anonymous) Authenticate(*http.Request) (*Identity, error) {
+	return &Identity{Subject: AnonymousSubject}, nil
+}
+
+// credential returns the token or API key of the request, from the Authorization bearer, the X-API-Key header
+// or the token query parameter for the clients that cannot set headers on the websocket upgrade.
+func credential(r *http.Request) (string, error) {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, bearerPrefix) {
+		return strings.TrimSpace(strings.TrimPrefix(header, bearerPrefix)), nil
+	}
+
+	if key := r.Header.Get(apiKeyHeader); key != "" {
+		return key, nil
+	}
+
+	if token := r.URL.Query().Get(tokenParam); token != "" {
+		return token, nil
+	}
+
+	return "", ErrMissingCredentials
+}
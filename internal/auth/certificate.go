@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// Subject is an entry of the subjects file.
+type Subject struct {
+	Subject string `json:"subject"`
+	Entitlements
+}
+
+// ClientCerts authenticates the clients with the certificates verified by the TLS handshake. The subject of a
+// client is the common name of its certificate, or its distinguished name without a common name. The entitlements
+// of the subjects are loaded from an optional JSON file:
+//
+//	{"subjects": [{"subject": "desk-a", "symbols": ["BTCUSDT"], "streams": ["bbo"]}]}
+//
+// Without the file, all the verified certificates have all the entitlements.
+type ClientCerts struct {
+	subjects map[string]*Identity
+}
+
+func NewClientCerts(path string) (*ClientCerts, error) {
+	c := &ClientCerts{}
+
+	if path == "" {
+		return c, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading subjects: %w", err)
+	}
+
+	var file struct {
+		Subjects []Subject `json:"subjects"`
+	}
+
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, fmt.Errorf("parsing subjects %s: %w", path, err)
+	}
+
+	c.subjects = make(map[string]*Identity, len(file.Subjects))
+
+	for i, s := range file.Subjects {
+		if s.Subject == "" {
+			return nil, fmt.Errorf("subject %d of %s is empty", i, path)
+		}
+
+		c.subjects[s.Subject] = &Identity{Subject: s.Subject, Entitlements: s.Entitlements}
+	}
+
+	return c, nil
+}
+
+func (c *ClientCerts) Authenticate(r *http.Request) (*Identity, error) {
+	// the chains are only set for the certificates verified by the handshake
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil, ErrMissingCredentials
+	}
+
+	subject := certSubject(r.TLS.VerifiedChains[0][0])
+
+	if c.subjects == nil {
+		return &Identity{Subject: subject}, nil
+	}
+
+	identity, ok := c.subjects[subject]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown subject %q", ErrInvalidCredentials, subject)
+	}
+
+	return identity, nil
+}
+
+func certSubject(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+
+	return cert.Subject.String()
+}
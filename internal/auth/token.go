@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	minHMACSecret = 32
+	clockLeeway   = 30 * time.Second
+)
+
+// claims of the tokens. The entitlements are the symbols and streams claims.
+type claims struct {
+	jwt.RegisteredClaims
+	Entitlements
+}
+
+// Tokens authenticates the clients with signed JWTs. The subject and the expiration are required.
+type Tokens struct {
+	parser  *jwt.Parser
+	keyfunc jwt.Keyfunc
+}
+
+// NewHMACTokens verifies the tokens signed by the issuer with a shared secret (HS256, HS384 or HS512).
+// An empty issuer or audience is not checked.
+func NewHMACTokens(secret, issuer, audience string) (*Tokens, error) {
+	if len(secret) < minHMACSecret {
+		return nil, fmt.Errorf("the HMAC secret must be at least %d bytes", minHMACSecret)
+	}
+
+	key := []byte(secret)
+
+	return newTokens([]string{"HS256", "HS384", "HS512"}, issuer, audience, func(*jwt.Token) (any, error) {
+		return key, nil
+	}), nil
+}
+
+// NewJWKSTokens verifies the tokens signed with the RSA or ECDSA keys of a local JWKS file.
+// The key is selected by the kid header, which can be omitted when the file has a single key.
+func NewJWKSTokens(path, issuer, audience string) (*Tokens, error) {
+	keys, err := loadJWKS(path)
+	if err != nil {
+		return nil, err
+	}
+
+	methods := []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+	return newTokens(methods, issuer, audience, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+
+		return keys.key(kid)
+	}), nil
+}
+
+func newTokens(methods []string, issuer, audience string, keyfunc jwt.Keyfunc) *Tokens {
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods(methods),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(clockLeeway),
+	}
+
+	if issuer != "" {
+		options = append(options, jwt.WithIssuer(issuer))
+	}
+
+	if audience != "" {
+		options = append(options, jwt.WithAudience(audience))
+	}
+
+	return &Tokens{
+		parser:  jwt.NewParser(options...),
+		keyfunc: keyfunc,
+	}
+}
+
+func (t *Tokens) Authenticate(r *http.Request) (*Identity, error) {
+	raw, err := credential(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var c claims
+
+	if _, err := t.parser.ParseWithClaims(raw, &c, t.keyfunc); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCredentials, err)
+	}
+
+	if c.Subject == "" {
+		return nil, fmt.Errorf("%w: token has no subject", ErrInvalidCredentials)
+	}
+
+	return &Identity{Subject: c.Subject, Entitlements: c.Entitlements}, nil
+}
@@ -0,0 +1,166 @@
+// Package certs loads the TLS certificates of the downstream server and reloads them when their files change.
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"ob-manager/internal/config"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Reloader serves the TLS configuration of the latest certificate files. The files are checked periodically and
+// reloaded when their modification time or size changes. A reload applies to the new handshakes only, so the
+// established connections are kept. A file failing to load keeps the previous configuration.
+type Reloader struct {
+	settings config.TLS
+	current  atomic.Pointer[tls.Config]
+	versions map[string]fileVersion
+}
+
+// fileVersion identifies the content of a file without reading it.
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewReloader loads the files of the settings. The files are watched by Run.
+func NewReloader(settings config.TLS) (*Reloader, error) {
+	r := &Reloader{
+		settings: settings,
+	}
+
+	cfg, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+
+	r.current.Store(cfg)
+	r.versions = r.stat()
+
+	return r, nil
+}
+
+// TLSConfig returns the configuration of the server. It resolves the latest configuration on each handshake.
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current.Load(), nil
+		},
+	}
+}
+
+// Run reloads the files when they change, until the context is done.
+func (r *Reloader) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.settings.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		versions := r.stat()
+		if !r.changed(versions) {
+			continue
+		}
+
+		cfg, err := r.load()
+		if err != nil {
+			// retried on the next change of the files, e.g. the key written after the certificate
+			slog.Error("Error on Reloading the TLS Certificates", "Error", err)
+			r.versions = versions
+
+			continue
+		}
+
+		r.current.Store(cfg)
+		r.versions = versions
+
+		slog.Info("TLS Certificates Reloaded", "Cert", r.settings.CertFile, "ClientCA", r.settings.ClientCAFile)
+	}
+}
+
+func (r *Reloader) files() []string {
+	files := []string{r.settings.CertFile, r.settings.KeyFile}
+	if r.settings.ClientCAFile != "" {
+		files = append(files, r.settings.ClientCAFile)
+	}
+
+	return files
+}
+
+// stat returns the versions of the files. The files failing the stat are left out.
+func (r *Reloader) stat() map[string]fileVersion {
+	versions := make(map[string]fileVersion, 3)
+
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+
+		versions[file] = fileVersion{modTime: info.ModTime(), size: info.Size()}
+	}
+
+	return versions
+}
+
+func (r *Reloader) changed(versions map[string]fileVersion) bool {
+	if len(versions) != len(r.versions) {
+		return true
+	}
+
+	for file, version := range versions {
+		if r.versions[file] != version {
+			return true
+		}
+	}
+
+	return false
+}
+
+// load reads the files and returns the configuration of the handshakes.
+func (r *Reloader) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(r.settings.CertFile, r.settings.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading the TLS certificate: %w", err)
+	}
+
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		// the websocket upgrade needs HTTP/1.1
+		NextProtos: []string{"http/1.1"},
+	}
+
+	if r.settings.ClientCAFile == "" {
+		return cfg, nil
+	}
+
+	pem, err := os.ReadFile(r.settings.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading the client CAs: %w", err)
+	}
+
+	cfg.ClientCAs = x509.NewCertPool()
+	if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate in the client CAs %s", r.settings.ClientCAFile)
+	}
+
+	switch r.settings.ClientAuth {
+	case config.ClientAuthRequire:
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case config.ClientAuthOptional:
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return cfg, nil
+}
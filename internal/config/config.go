@@ -0,0 +1,539 @@
+// Package config loads the service configuration from the environment.
+package config
+
+import (
+	"compress/flate"
+	"fmt"
+	"ob-manager/internal/queues"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	// Symbols are the currency pairs subscribed from the upstream.
+	Symbols []string
+	// Addr is the listen address of the downstream server.
+	Addr string
+	// StaleAfter is the maximum time without events before a book is considered stale.
+	StaleAfter time.Duration
+	// MaxEventLag is the maximum delay between the event time and its reception before a book is considered stale.
+	MaxEventLag time.Duration
+	// InQueue are the size and the overflow policy of the in-queue of each currency pair.
+	InQueue queues.Settings
+	// OutQueue are the size and the overflow policy of each out-queue shard.
+	OutQueue queues.Settings
+	// OutQueueShards is the number of out-queue shards, each drained by its own fan-out worker.
+	OutQueueShards int
+	// SendBuffer is the number of messages buffered for each downstream connection.
+	// A connection whose buffer is full is closed as a slow consumer.
+	SendBuffer int
+	// Compression configures the permessage-deflate compression of the downstream messages.
+	Compression Compression
+	// Keepalive configures the liveness checks and the limits of the downstream connections.
+	Keepalive Keepalive
+	// Auth configures the authentication of the downstream clients.
+	Auth Auth
+	// Limits are the quotas of the downstream clients.
+	Limits Limits
+	// TLS configures the TLS termination of the downstream server.
+	TLS TLS
+	// DrainTimeout is the maximum time to write the messages buffered for the subscribers on shutdown.
+	DrainTimeout time.Duration
+	// Analytics configures the metrics derived from the order books.
+	Analytics Analytics
+}
+
+// Analytics configures the metrics derived from the order books.
+type Analytics struct {
+	// Interval is the minimum time between two analytics messages of a currency pair. 0 publishes after each update.
+	Interval time.Duration
+	// ImbalanceDepth is the number of levels on each side used for the order book imbalance.
+	ImbalanceDepth int
+	// DepthBands are the distances from the mid price in basis points of the cumulative notionals.
+	DepthBands []float64
+}
+
+// Client certificate policies of the downstream server.
+const (
+	ClientAuthNone     = "none"
+	ClientAuthOptional = "optional"
+	ClientAuthRequire  = "require"
+)
+
+// TLS configures the TLS termination of the downstream server. The server is plain HTTP without a certificate.
+type TLS struct {
+	// CertFile and KeyFile are the PEM files of the certificate chain and the private key of the server.
+	CertFile string
+	KeyFile  string
+	// ClientCAFile is the PEM file of the CAs verifying the client certificates.
+	ClientCAFile string
+	// ClientAuth is none, optional or require. The client certificates are verified with ClientCAFile.
+	ClientAuth string
+	// ReloadInterval is the interval of the checks of the files, which are reloaded when they change.
+	ReloadInterval time.Duration
+}
+
+// Enabled reports whether the downstream server terminates TLS.
+func (t TLS) Enabled() bool {
+	return t.CertFile != ""
+}
+
+// Limits are the quotas of the downstream clients. A zero limit is not enforced.
+type Limits struct {
+	// MaxConnsPerIP is the maximum number of connections from an IP address.
+	MaxConnsPerIP int
+	// MaxConnsPerKey is the maximum number of connections of an authenticated subject.
+	MaxConnsPerKey int
+	// MaxSubscriptions is the maximum number of subscriptions of a connection.
+	MaxSubscriptions int
+	// CommandRate is the number of commands per second a connection may send, with bursts of CommandBurst.
+	CommandRate  float64
+	CommandBurst int
+	// MaxViolations is the number of rejected commands after which the connection is closed.
+	MaxViolations int
+}
+
+// Auth configures the authentication of the downstream clients.
+type Auth struct {
+	// Mode is none, apikey, hmac, jwt or mtls.
+	Mode string
+	// KeysFile is the JSON file of the API keys and their entitlements, for the apikey mode.
+	KeysFile string
+	// HMACSecret is the shared secret of the tokens, for the hmac mode.
+	HMACSecret string
+	// JWKSFile is the JWKS file of the public keys of the tokens, for the jwt mode.
+	JWKSFile string
+	// SubjectsFile is the JSON file of the entitlements of the client certificate subjects, for the mtls mode.
+	// All the verified certificates have all the entitlements without it.
+	SubjectsFile string
+	// Issuer and Audience are checked in the tokens when they are set.
+	Issuer   string
+	Audience string
+	// AllowedOrigins are the origins of the browsers allowed to connect. Empty allows all the origins.
+	AllowedOrigins []string
+}
+
+// Keepalive configures the liveness checks and the limits of the downstream connections.
+type Keepalive struct {
+	// PingInterval is the interval of the pings sent by the server.
+	PingInterval time.Duration
+	// IdleTimeout closes the connections that sent no message or pong within this duration.
+	IdleTimeout time.Duration
+	// MaxMessageSize is the maximum size in bytes of the messages sent by the clients.
+	MaxMessageSize int64
+}
+
+// Compression configures the permessage-deflate compression of the downstream messages.
+type Compression struct {
+	// Enabled accepts the compression when the client offers it.
+	Enabled bool
+	// Level is the flate compression level, from -2 (Huffman only) to 9 (best compression).
+	Level int
+	// Threshold is the minimum size in bytes of the compressed messages.
+	Threshold int
+}
+
+// Load reads the configuration from the OBM_* environment variables, falling back to the defaults.
+func Load() (*Config, error) {
+	var err error
+
+	cfg := &Config{
+		Symbols: envList("OBM_SYMBOLS", []string{"BTCUSDT", "ETHUSDT"}),
+		Addr:    envString("OBM_ADDR", ":8080"),
+	}
+
+	if cfg.StaleAfter, err = envDuration("OBM_STALE_AFTER", 10*time.Second); err != nil {
+		return nil, err
+	}
+
+	if cfg.MaxEventLag, err = envDuration("OBM_MAX_EVENT_LAG", 5*time.Second); err != nil {
+		return nil, err
+	}
+
+	if cfg.InQueue, err = queueSettings("OBM_INQ", 10000); err != nil {
+		return nil, err
+	}
+
+	if cfg.OutQueue, err = queueSettings("OBM_OUTQ", 40000); err != nil {
+		return nil, err
+	}
+
+	if cfg.OutQueueShards, err = envInt("OBM_OUTQ_SHARDS", 4); err != nil {
+		return nil, err
+	}
+
+	if cfg.OutQueueShards < 1 {
+		return nil, fmt.Errorf("OBM_OUTQ_SHARDS must be positive")
+	}
+
+	if cfg.SendBuffer, err = envInt("OBM_SEND_BUFFER", 1024); err != nil {
+		return nil, err
+	}
+
+	if cfg.SendBuffer < 1 {
+		return nil, fmt.Errorf("OBM_SEND_BUFFER must be positive")
+	}
+
+	if cfg.Compression, err = compression(); err != nil {
+		return nil, err
+	}
+
+	if cfg.Keepalive, err = keepalive(); err != nil {
+		return nil, err
+	}
+
+	cfg.Auth = Auth{
+		Mode:           strings.ToLower(envString("OBM_AUTH", "none")),
+		KeysFile:       envString("OBM_AUTH_KEYS_FILE", ""),
+		HMACSecret:     envString("OBM_AUTH_HMAC_SECRET", ""),
+		JWKSFile:       envString("OBM_AUTH_JWKS_FILE", ""),
+		SubjectsFile:   envString("OBM_AUTH_SUBJECTS_FILE", ""),
+		Issuer:         envString("OBM_AUTH_ISSUER", ""),
+		Audience:       envString("OBM_AUTH_AUDIENCE", ""),
+		AllowedOrigins: envList("OBM_ALLOWED_ORIGINS", nil),
+	}
+
+	if cfg.Limits, err = limits(); err != nil {
+		return nil, err
+	}
+
+	if cfg.TLS, err = tlsSettings(); err != nil {
+		return nil, err
+	}
+
+	if cfg.DrainTimeout, err = envDuration("OBM_DRAIN_TIMEOUT", 5*time.Second); err != nil {
+		return nil, err
+	}
+
+	if cfg.Analytics, err = analytics(); err != nil {
+		return nil, err
+	}
+
+	if cfg.Auth.Mode == "mtls" && cfg.TLS.ClientAuth == ClientAuthNone {
+		return nil, fmt.Errorf("OBM_AUTH=mtls needs OBM_TLS_CLIENT_CA_FILE")
+	}
+
+	if len(cfg.Symbols) == 0 {
+		return nil, fmt.Errorf("OBM_SYMBOLS must list at least one currency pair")
+	}
+
+	return cfg, nil
+}
+
+// queueSettings reads the <prefix>_SIZE and <prefix>_POLICY variables. The default policy is to block.
+func queueSettings(prefix string, defSize int) (queues.Settings, error) {
+	var (
+		settings queues.Settings
+		err      error
+	)
+
+	if settings.Size, err = envInt(prefix+"_SIZE", defSize); err != nil {
+		return settings, err
+	}
+
+	if settings.Size < 1 {
+		return settings, fmt.Errorf("%s_SIZE must be positive", prefix)
+	}
+
+	if settings.Policy, err = queues.ParsePolicy(envString(prefix+"_POLICY", string(queues.Block))); err != nil {
+		return settings, fmt.Errorf("invalid %s_POLICY: %w", prefix, err)
+	}
+
+	return settings, nil
+}
+
+// compression reads the OBM_COMPRESSION* variables. The compression is disabled by default.
+func compression() (Compression, error) {
+	var (
+		c   Compression
+		err error
+	)
+
+	if c.Enabled, err = envBool("OBM_COMPRESSION", false); err != nil {
+		return c, err
+	}
+
+	if c.Level, err = envInt("OBM_COMPRESSION_LEVEL", flate.BestSpeed); err != nil {
+		return c, err
+	}
+
+	if c.Level < flate.HuffmanOnly || c.Level > flate.BestCompression {
+		return c, fmt.Errorf("OBM_COMPRESSION_LEVEL must be between %d and %d", flate.HuffmanOnly, flate.BestCompression)
+	}
+
+	if c.Threshold, err = envInt("OBM_COMPRESSION_THRESHOLD", 1024); err != nil {
+		return c, err
+	}
+
+	if c.Threshold < 0 {
+		return c, fmt.Errorf("OBM_COMPRESSION_THRESHOLD must not be negative")
+	}
+
+	return c, nil
+}
+
+// keepalive reads the OBM_PING_INTERVAL, OBM_IDLE_TIMEOUT and OBM_MAX_MESSAGE_SIZE variables.
+func keepalive() (Keepalive, error) {
+	var (
+		k   Keepalive
+		err error
+	)
+
+	if k.PingInterval, err = envDuration("OBM_PING_INTERVAL", 20*time.Second); err != nil {
+		return k, err
+	}
+
+	if k.IdleTimeout, err = envDuration("OBM_IDLE_TIMEOUT", 60*time.Second); err != nil {
+		return k, err
+	}
+
+	if k.PingInterval <= 0 || k.IdleTimeout <= k.PingInterval {
+		return k, fmt.Errorf("OBM_PING_INTERVAL must be positive and shorter than OBM_IDLE_TIMEOUT")
+	}
+
+	size, err := envInt("OBM_MAX_MESSAGE_SIZE", 4096)
+	if err != nil {
+		return k, err
+	}
+
+	if size < 1 {
+		return k, fmt.Errorf("OBM_MAX_MESSAGE_SIZE must be positive")
+	}
+
+	k.MaxMessageSize = int64(size)
+
+	return k, nil
+}
+
+// limits reads the OBM_MAX_* and OBM_COMMAND_* quota variables.
+func limits() (Limits, error) {
+	var (
+		l   Limits
+		err error
+	)
+
+	ints := []struct {
+		key   string
+		def   int
+		value *int
+	}{
+		{"OBM_MAX_CONNS_PER_IP", 100, &l.MaxConnsPerIP},
+		{"OBM_MAX_CONNS_PER_KEY", 20, &l.MaxConnsPerKey},
+		{"OBM_MAX_SUBSCRIPTIONS", 100, &l.MaxSubscriptions},
+		{"OBM_COMMAND_BURST", 20, &l.CommandBurst},
+		{"OBM_MAX_VIOLATIONS", 10, &l.MaxViolations},
+	}
+
+	for _, i := range ints {
+		if *i.value, err = envInt(i.key, i.def); err != nil {
+			return l, err
+		}
+
+		if *i.value < 0 {
+			return l, fmt.Errorf("%s must not be negative", i.key)
+		}
+	}
+
+	if l.CommandRate, err = envFloat("OBM_COMMAND_RATE", 10); err != nil {
+		return l, err
+	}
+
+	if l.CommandRate < 0 {
+		return l, fmt.Errorf("OBM_COMMAND_RATE must not be negative")
+	}
+
+	return l, nil
+}
+
+// analytics reads the OBM_ANALYTICS_* variables.
+func analytics() (Analytics, error) {
+	var (
+		a   Analytics
+		err error
+	)
+
+	if a.Interval, err = envDuration("OBM_ANALYTICS_INTERVAL", 100*time.Millisecond); err != nil {
+		return a, err
+	}
+
+	if a.Interval < 0 {
+		return a, fmt.Errorf("OBM_ANALYTICS_INTERVAL must not be negative")
+	}
+
+	if a.ImbalanceDepth, err = envInt("OBM_ANALYTICS_IMBALANCE_DEPTH", 10); err != nil {
+		return a, err
+	}
+
+	if a.ImbalanceDepth < 1 {
+		return a, fmt.Errorf("OBM_ANALYTICS_IMBALANCE_DEPTH must be positive")
+	}
+
+	if a.DepthBands, err = envFloatList("OBM_ANALYTICS_DEPTH_BANDS", []float64{10, 25, 50, 100}); err != nil {
+		return a, err
+	}
+
+	for _, bps := range a.DepthBands {
+		if bps <= 0 {
+			return a, fmt.Errorf("OBM_ANALYTICS_DEPTH_BANDS must be positive basis points")
+		}
+	}
+
+	return a, nil
+}
+
+// tlsSettings reads the OBM_TLS_* variables. The client certificates are required when a client CA is set,
+// unless OBM_TLS_CLIENT_AUTH is optional.
+func tlsSettings() (TLS, error) {
+	var (
+		t   TLS
+		err error
+	)
+
+	t.CertFile = envString("OBM_TLS_CERT_FILE", "")
+	t.KeyFile = envString("OBM_TLS_KEY_FILE", "")
+	t.ClientCAFile = envString("OBM_TLS_CLIENT_CA_FILE", "")
+
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return t, fmt.Errorf("OBM_TLS_CERT_FILE and OBM_TLS_KEY_FILE must be set together")
+	}
+
+	clientAuth := ClientAuthNone
+	if t.ClientCAFile != "" {
+		clientAuth = ClientAuthRequire
+	}
+
+	t.ClientAuth = strings.ToLower(envString("OBM_TLS_CLIENT_AUTH", clientAuth))
+
+	switch t.ClientAuth {
+	case ClientAuthNone:
+	case ClientAuthOptional, ClientAuthRequire:
+		if t.ClientCAFile == "" || !t.Enabled() {
+			return t, fmt.Errorf("OBM_TLS_CLIENT_AUTH=%s needs OBM_TLS_CERT_FILE and OBM_TLS_CLIENT_CA_FILE", t.ClientAuth)
+		}
+	default:
+		return t, fmt.Errorf("invalid OBM_TLS_CLIENT_AUTH %q", t.ClientAuth)
+	}
+
+	if t.ReloadInterval, err = envDuration("OBM_TLS_RELOAD_INTERVAL", 30*time.Second); err != nil {
+		return t, err
+	}
+
+	if t.ReloadInterval <= 0 {
+		return t, fmt.Errorf("OBM_TLS_RELOAD_INTERVAL must be positive")
+	}
+
+	return t, nil
+}
+
+func envString(key, def string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+
+	return def
+}
+
+// envList reads a comma separated list of upper case values.
+func envList(key string, def []string) []string {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def
+	}
+
+	list := make([]string, 0)
+
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.ToUpper(strings.TrimSpace(item)); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+// envFloatList reads a comma separated list of numbers. An empty list is invalid.
+func envFloatList(key string, def []float64) ([]float64, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def, nil
+	}
+
+	var list []float64
+
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		f, err := strconv.ParseFloat(item, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", key, err)
+		}
+
+		list = append(list, f)
+	}
+
+	if len(list) == 0 {
+		return nil, fmt.Errorf("%s must list at least one value", key)
+	}
+
+	return list, nil
+}
+
+func envInt(key string, def int) (int, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def, nil
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+
+	return i, nil
+}
+
+func envFloat(key string, def float64) (float64, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def, nil
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+
+	return f, nil
+}
+
+func envBool(key string, def bool) (bool, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def, nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %w", key, err)
+	}
+
+	return b, nil
+}
+
+func envDuration(key string, def time.Duration) (time.Duration, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+
+	return d, nil
+}
@@ -1,5 +1,7 @@
 package dtos
 
+import "slices"
+
 type EventUpdate struct {
 	EventType     string     `json:"e"`
 	EventTime     int        `json:"E"`
@@ -9,3 +11,35 @@ type EventUpdate struct {
 	Bids          [][]string `json:"b"`
 	Asks          [][]string `json:"a"`
 }
+
+// Merge returns an update covering this update followed by the next one.
+// The levels are merged keeping the latest quantity of each price.
+func (e *EventUpdate) Merge(next *EventUpdate) *EventUpdate {
+	return &EventUpdate{
+		EventType:     next.EventType,
+		EventTime:     next.EventTime,
+		Symbol:        next.Symbol,
+		FirstUpdateId: e.FirstUpdateId,
+		FinalUpdateId: next.FinalUpdateId,
+		Bids:          mergeLevels(e.Bids, next.Bids),
+		Asks:          mergeLevels(e.Asks, next.Asks),
+	}
+}
+
+func mergeLevels(levels, next [][]string) [][]string {
+	merged := make([][]string, 0, len(levels)+len(next))
+	index := make(map[string]int, len(levels)+len(next))
+
+	for _, level := range slices.Concat(levels, next) {
+		if i, ok := index[level[0]]; ok {
+			merged[i] = level
+
+			continue
+		}
+
+		index[level[0]] = len(merged)
+		merged = append(merged, level)
+	}
+
+	return merged
+}
@@ -0,0 +1,116 @@
+package dtos
+
+// MessageType discriminates the downstream messages sent to the subscribers.
+type MessageType string
+
+const (
+	TypeSnapshot     MessageType = "snapshot"
+	TypeDelta        MessageType = "delta"
+	TypeResync       MessageType = "resync"
+	TypeSubscribed   MessageType = "subscribed"
+	TypeUnsubscribed MessageType = "unsubscribed"
+	TypeError        MessageType = "error"
+	TypeHeartbeat    MessageType = "heartbeat"
+	TypeBBO          MessageType = "bbo"
+	TypeAnalytics    MessageType = "analytics"
+	TypeImpact       MessageType = "impact"
+	TypeStatus       MessageType = "status"
+)
+
+// Side of a market order.
+type Side string
+
+const (
+	SideBuy  Side = "buy"
+	SideSell Side = "sell"
+)
+
+// Message is the envelope of every message sent to the downstream subscribers.
+// Seq is the last update id covered by the message and PrevSeq is the Seq of the previous
+// message of the stream, so that the subscribers can detect gaps.
+type Message struct {
+	Type    MessageType `json:"type"`
+	Symbol  string      `json:"symbol,omitempty"`
+	Seq     int         `json:"seq,omitempty"`
+	PrevSeq int         `json:"prevSeq,omitempty"`
+	Ts      int64       `json:"ts"`
+	Data    any         `json:"data,omitempty"`
+}
+
+// BBO is the payload of the bbo message with the best bid and the best ask of the order book.
+// The fields are empty when a side of the book is empty.
+type BBO struct {
+	BidPrice string `json:"bidPrice"`
+	BidQty   string `json:"bidQty"`
+	AskPrice string `json:"askPrice"`
+	AskQty   string `json:"askQty"`
+}
+
+// Analytics is the payload of the analytics message with the metrics derived from the order book.
+// The metrics are 0 when a side of the book is empty.
+type Analytics struct {
+	Mid            float64      `json:"mid"`
+	SpreadBps      float64      `json:"spreadBps"`
+	Microprice     float64      `json:"microprice"`
+	Imbalance      float64      `json:"imbalance"`
+	ImbalanceDepth int          `json:"imbalanceDepth"`
+	Depth          []DepthAtBps `json:"depth"`
+}
+
+// DepthAtBps is the cumulative notional of each side within Bps basis points of the mid price.
+type DepthAtBps struct {
+	Bps         float64 `json:"bps"`
+	BidNotional float64 `json:"bidNotional"`
+	AskNotional float64 `json:"askNotional"`
+}
+
+// Impact is the payload of the impact message with the estimated fill of a market order walking the book.
+// Complete is false when the book does not have enough liquidity to fill the quantity.
+type Impact struct {
+	Id             string  `json:"id,omitempty"`
+	Side           Side    `json:"side"`
+	Qty            float64 `json:"qty"`
+	FilledQty      float64 `json:"filledQty"`
+	Notional       float64 `json:"notional"`
+	Vwap           float64 `json:"vwap"`
+	WorstPrice     float64 `json:"worstPrice"`
+	LevelsConsumed int     `json:"levelsConsumed"`
+	Mid            float64 `json:"mid"`
+	SlippageBps    float64 `json:"slippageBps"`
+	Complete       bool    `json:"complete"`
+}
+
+// SubscriptionAck is the payload of the subscribed and unsubscribed messages.
+type SubscriptionAck struct {
+	Symbol string `json:"symbol"`
+	Stream string `json:"stream,omitempty"`
+}
+
+// ResyncNotice is the payload of the resync message. The subscriber will receive a new snapshot.
+type ResyncNotice struct {
+	Reason string `json:"reason"`
+}
+
+// StatusNotice is the payload of the status message sent when the sync state of the order book changes.
+// Subscribers must not rely on the book while the state is not live.
+type StatusNotice struct {
+	State BookState `json:"state"`
+}
+
+// ErrorMessage is the payload of the error message.
+type ErrorMessage struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+const (
+	ErrCodeBadRequest     = "bad_request"
+	ErrCodeUnknownCommand = "unknown_command"
+	ErrCodeUnknownSymbol  = "unknown_symbol"
+	ErrCodeNotSynced      = "not_synced"
+	ErrCodeInternal       = "internal_error"
+	ErrCodeUnauthorized   = "unauthorized"
+	ErrCodeForbidden      = "forbidden"
+	ErrCodeLimitExceeded  = "limit_exceeded"
+	ErrCodeRateLimited    = "rate_limited"
+)
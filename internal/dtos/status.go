@@ -0,0 +1,32 @@
+package dtos
+
+// BookState is the sync state of an order book with the upstream.
+type BookState string
+
+const (
+	// BookSyncing waits for the snapshot or the first update after a (re)connection.
+	BookSyncing BookState = "syncing"
+	// BookLive is in sequence with the upstream and updated within the staleness threshold.
+	BookLive BookState = "live"
+	// BookStale did not receive an update within the staleness threshold.
+	BookStale BookState = "stale"
+	// BookOutOfSequence missed updates from the upstream.
+	BookOutOfSequence BookState = "out_of_sequence"
+)
+
+// SymbolStatus is the state of the order book of a currency pair.
+// LastEventAgeMs is -1 until the first update is applied.
+type SymbolStatus struct {
+	Symbol         string    `json:"symbol"`
+	State          BookState `json:"state"`
+	LastUpdateId   int       `json:"lastUpdateId"`
+	LastEventAgeMs int64     `json:"lastEventAgeMs"`
+	Subscribers    int       `json:"subscribers"`
+}
+
+// ServiceStatus is the state of the service returned by the status endpoint.
+type ServiceStatus struct {
+	Ready             bool           `json:"ready"`
+	UpstreamConnected bool           `json:"upstreamConnected"`
+	Symbols           []SymbolStatus `json:"symbols"`
+}
@@ -0,0 +1,135 @@
+// Package encoding encodes the downstream messages as JSON, MessagePack or Protobuf.
+package encoding
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"ob-manager/internal/dtos"
+
+	"github.com/gorilla/websocket"
+)
+
+// Encoding of the downstream messages, negotiated when the websocket connects.
+type Encoding string
+
+const (
+	JSON     Encoding = "json"
+	MsgPack  Encoding = "msgpack"
+	Protobuf Encoding = "protobuf"
+)
+
+const (
+	subprotocolPrefix  = "obm."
+	subprotocolVersion = ".v1"
+)
+
+// Encodings are the supported encodings, in the order of preference of the subprotocols.
+var Encodings = []Encoding{JSON, MsgPack, Protobuf}
+
+// Parse returns the encoding of the given name.
+func Parse(name string) (Encoding, error) {
+	for _, e := range Encodings {
+		if string(e) == strings.ToLower(name) {
+			return e, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown encoding %q", name)
+}
+
+// Subprotocols returns the websocket subprotocols of the encodings.
+func Subprotocols() []string {
+	protocols := make([]string, 0, len(Encodings))
+
+	for _, e := range Encodings {
+		protocols = append(protocols, e.Subprotocol())
+	}
+
+	return protocols
+}
+
+// FromSubprotocol returns the encoding of a websocket subprotocol. ok is false if it is not one of Subprotocols.
+func FromSubprotocol(protocol string) (e Encoding, ok bool) {
+	for _, e := range Encodings {
+		if e.Subprotocol() == protocol {
+			return e, true
+		}
+	}
+
+	return "", false
+}
+
+// Subprotocol returns the websocket subprotocol of the encoding, e.g. obm.msgpack.v1.
+func (e Encoding) Subprotocol() string {
+	return subprotocolPrefix + string(e) + subprotocolVersion
+}
+
+// FrameType returns the websocket frame type of the encoded messages.
+func (e Encoding) FrameType() int {
+	if e == JSON {
+		return websocket.TextMessage
+	}
+
+	return websocket.BinaryMessage
+}
+
+// Marshal encodes a message. The binary encodings send the prices and quantities as numbers.
+func (e Encoding) Marshal(message *dtos.Message) ([]byte, error) {
+	switch e {
+	case MsgPack:
+		return marshalMsgPack(message)
+	case Protobuf:
+		return marshalProtobuf(message)
+	default:
+		return json.Marshal(message)
+	}
+}
+
+// levels converts the price levels to numbers.
+func levels(levels [][]string) ([][2]float64, error) {
+	numeric := make([][2]float64, 0, len(levels))
+
+	for _, level := range levels {
+		if len(level) < 2 {
+			return nil, fmt.Errorf("invalid price level %v", level)
+		}
+
+		price, err := strconv.ParseFloat(level[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid price %q: %w", level[0], err)
+		}
+
+		qty, err := strconv.ParseFloat(level[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quantity %q: %w", level[1], err)
+		}
+
+		numeric = append(numeric, [2]float64{price, qty})
+	}
+
+	return numeric, nil
+}
+
+// bbo converts the best bid and ask to numbers.
+func bbo(b dtos.BBO) ([4]float64, error) {
+	var numeric [4]float64
+
+	for i, value := range []string{b.BidPrice, b.BidQty, b.AskPrice, b.AskQty} {
+		// an empty side of the book has no best price
+		if value == "" {
+			continue
+		}
+
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return numeric, fmt.Errorf("invalid best bid/ask %q: %w", value, err)
+		}
+
+		numeric[i] = f
+	}
+
+	return numeric, nil
+}
@@ -0,0 +1,268 @@
+package encoding
+
+import (
+	"encoding/json"
+	"reflect"
+	"slices"
+	"testing"
+
+	"ob-manager/internal/dtos"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const testTs = 1700000000000
+
+// testMessage is a message of each type with its payload.
+type testMessage struct {
+	name    string
+	message *dtos.Message
+}
+
+func testMessages() []testMessage {
+	return []testMessage{
+		{"snapshot", &dtos.Message{Type: dtos.TypeSnapshot, Symbol: "BTCUSDT", Seq: 1000, Ts: testTs,
+			Data: &dtos.Snapshot{
+				LastUpdateId: 1000,
+				Bids:         [][]string{{"65000.5", "1.25"}, {"64999", "3"}},
+				Asks:         [][]string{{"65001", "0.5"}},
+			}}},
+		{"delta", &dtos.Message{Type: dtos.TypeDelta, Symbol: "BTCUSDT", Seq: 1002, PrevSeq: 1000, Ts: testTs,
+			Data: &dtos.EventUpdate{
+				EventType:     "depthUpdate",
+				EventTime:     testTs,
+				Symbol:        "BTCUSDT",
+				FirstUpdateId: 1001,
+				FinalUpdateId: 1002,
+				Bids:          [][]string{{"65000.5", "0"}},
+				Asks:          [][]string{{"65001", "2.5"}, {"65002", "1"}},
+			}}},
+		{"bbo", &dtos.Message{Type: dtos.TypeBBO, Symbol: "BTCUSDT", Seq: 1002, PrevSeq: 1000, Ts: testTs,
+			Data: dtos.BBO{BidPrice: "64999", BidQty: "3", AskPrice: "65001", AskQty: "2.5"}}},
+		{"analytics", &dtos.Message{Type: dtos.TypeAnalytics, Symbol: "BTCUSDT", Seq: 1002, Ts: testTs,
+			Data: &dtos.Analytics{
+				Mid:            65000,
+				SpreadBps:      0.3,
+				Microprice:     65000.9,
+				Imbalance:      0.09,
+				ImbalanceDepth: 10,
+				Depth:          []dtos.DepthAtBps{{Bps: 10, BidNotional: 194997, AskNotional: 227507.5}},
+			}}},
+		{"impact", &dtos.Message{Type: dtos.TypeImpact, Symbol: "BTCUSDT", Seq: 1002, Ts: testTs,
+			Data: &dtos.Impact{
+				Id:             "42",
+				Side:           dtos.SideBuy,
+				Qty:            3,
+				FilledQty:      3,
+				Notional:       195003.5,
+				Vwap:           65001.25,
+				WorstPrice:     65002,
+				LevelsConsumed: 2,
+				Mid:            65000,
+				SlippageBps:    0.19,
+				Complete:       true,
+			}}},
+		{"ack", &dtos.Message{Type: dtos.TypeSubscribed, Symbol: "BTCUSDT", Ts: testTs,
+			Data: dtos.SubscriptionAck{Symbol: "BTCUSDT", Stream: "depth"}}},
+		{"resync", &dtos.Message{Type: dtos.TypeResync, Symbol: "BTCUSDT", Ts: testTs,
+			Data: dtos.ResyncNotice{Reason: "out of sequence"}}},
+		{"status", &dtos.Message{Type: dtos.TypeStatus, Symbol: "BTCUSDT", Seq: 1002, Ts: testTs,
+			Data: dtos.StatusNotice{State: dtos.BookStale}}},
+		{"error", &dtos.Message{Type: dtos.TypeError, Ts: testTs,
+			Data: dtos.ErrorMessage{Code: dtos.ErrCodeUnknownSymbol, Message: "unknown symbol FOO"}}},
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    Encoding
+		wantErr bool
+	}{
+		{name: "json", want: JSON},
+		{name: "MsgPack", want: MsgPack},
+		{name: "PROTOBUF", want: Protobuf},
+		{name: "xml", wantErr: true},
+		{name: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := Parse(tt.name)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Parse(%q) error = %v, wantErr %t", tt.name, err, tt.wantErr)
+		}
+
+		if got != tt.want {
+			t.Errorf("Parse(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFromSubprotocol(t *testing.T) {
+	for _, e := range Encodings {
+		if !slices.Contains(Subprotocols(), e.Subprotocol()) {
+			t.Errorf("Subprotocols() = %v, missing %s", Subprotocols(), e.Subprotocol())
+		}
+
+		got, ok := FromSubprotocol(e.Subprotocol())
+		if !ok || got != e {
+			t.Errorf("FromSubprotocol(%q) = %q, %t, want %q", e.Subprotocol(), got, ok, e)
+		}
+
+		parsed, err := Parse(string(e))
+		if err != nil || parsed != e {
+			t.Errorf("Parse(%q) = %q, %v, want %q", e, parsed, err, e)
+		}
+	}
+
+	if got := MsgPack.Subprotocol(); got != "obm.msgpack.v1" {
+		t.Errorf("MsgPack.Subprotocol() = %q, want obm.msgpack.v1", got)
+	}
+
+	for _, protocol := range []string{"", "obm.xml.v1", "obm.json.v2", "json"} {
+		if got, ok := FromSubprotocol(protocol); ok {
+			t.Errorf("FromSubprotocol(%q) = %q, want not ok", protocol, got)
+		}
+	}
+}
+
+func TestFrameType(t *testing.T) {
+	want := map[Encoding]int{
+		JSON:     websocket.TextMessage,
+		MsgPack:  websocket.BinaryMessage,
+		Protobuf: websocket.BinaryMessage,
+	}
+
+	for e, frameType := range want {
+		if got := e.FrameType(); got != frameType {
+			t.Errorf("%s.FrameType() = %d, want %d", e, got, frameType)
+		}
+	}
+}
+
+// TestMarshalRoundTrip decodes the JSON and MessagePack frames and compares them to the JSON messages.
+// The MessagePack frames have the keys of the JSON messages with numeric price levels and best bid and ask.
+func TestMarshalRoundTrip(t *testing.T) {
+	want := map[string]struct{ json, msgpack string }{
+		"snapshot": {
+			json: `{"type":"snapshot","symbol":"BTCUSDT","seq":1000,"ts":1700000000000,` +
+				`"data":{"lastUpdateId":1000,"bids":[["65000.5","1.25"],["64999","3"]],"asks":[["65001","0.5"]]}}`,
+			msgpack: `{"type":"snapshot","symbol":"BTCUSDT","seq":1000,"ts":1700000000000,` +
+				`"data":{"lastUpdateId":1000,"bids":[[65000.5,1.25],[64999,3]],"asks":[[65001,0.5]]}}`,
+		},
+		"delta": {
+			json: `{"type":"delta","symbol":"BTCUSDT","seq":1002,"prevSeq":1000,"ts":1700000000000,` +
+				`"data":{"e":"depthUpdate","E":1700000000000,"s":"BTCUSDT","U":1001,"u":1002,` +
+				`"b":[["65000.5","0"]],"a":[["65001","2.5"],["65002","1"]]}}`,
+			msgpack: `{"type":"delta","symbol":"BTCUSDT","seq":1002,"prevSeq":1000,"ts":1700000000000,` +
+				`"data":{"e":"depthUpdate","E":1700000000000,"s":"BTCUSDT","U":1001,"u":1002,` +
+				`"b":[[65000.5,0]],"a":[[65001,2.5],[65002,1]]}}`,
+		},
+		"bbo": {
+			json: `{"type":"bbo","symbol":"BTCUSDT","seq":1002,"prevSeq":1000,"ts":1700000000000,` +
+				`"data":{"bidPrice":"64999","bidQty":"3","askPrice":"65001","askQty":"2.5"}}`,
+			msgpack: `{"type":"bbo","symbol":"BTCUSDT","seq":1002,"prevSeq":1000,"ts":1700000000000,` +
+				`"data":{"bidPrice":64999,"bidQty":3,"askPrice":65001,"askQty":2.5}}`,
+		},
+		"analytics": {
+			json: `{"type":"analytics","symbol":"BTCUSDT","seq":1002,"ts":1700000000000,` +
+				`"data":{"mid":65000,"spreadBps":0.3,"microprice":65000.9,"imbalance":0.09,"imbalanceDepth":10,` +
+				`"depth":[{"bps":10,"bidNotional":194997,"askNotional":227507.5}]}}`,
+		},
+		"impact": {
+			json: `{"type":"impact","symbol":"BTCUSDT","seq":1002,"ts":1700000000000,` +
+				`"data":{"id":"42","side":"buy","qty":3,"filledQty":3,"notional":195003.5,"vwap":65001.25,` +
+				`"worstPrice":65002,"levelsConsumed":2,"mid":65000,"slippageBps":0.19,"complete":true}}`,
+		},
+		"ack": {
+			json: `{"type":"subscribed","symbol":"BTCUSDT","ts":1700000000000,` +
+				`"data":{"symbol":"BTCUSDT","stream":"depth"}}`,
+		},
+		"resync": {
+			json: `{"type":"resync","symbol":"BTCUSDT","ts":1700000000000,"data":{"reason":"out of sequence"}}`,
+		},
+		"status": {
+			json: `{"type":"status","symbol":"BTCUSDT","seq":1002,"ts":1700000000000,"data":{"state":"stale"}}`,
+		},
+		"error": {
+			json: `{"type":"error","ts":1700000000000,` +
+				`"data":{"code":"unknown_symbol","message":"unknown symbol FOO"}}`,
+		},
+	}
+
+	for _, tm := range testMessages() {
+		expected, ok := want[tm.name]
+		if !ok {
+			t.Fatalf("no expected messages for %s", tm.name)
+		}
+
+		// the other payloads are encoded as they are
+		if expected.msgpack == "" {
+			expected.msgpack = expected.json
+		}
+
+		t.Run(tm.name+"/json", func(t *testing.T) {
+			frame, err := JSON.Marshal(tm.message)
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+
+			var decoded any
+			if err := json.Unmarshal(frame, &decoded); err != nil {
+				t.Fatalf("decoding %s: %v", frame, err)
+			}
+
+			assertJSON(t, decoded, expected.json)
+		})
+
+		t.Run(tm.name+"/msgpack", func(t *testing.T) {
+			frame, err := MsgPack.Marshal(tm.message)
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+
+			var decoded map[string]any
+			if err := msgpack.Unmarshal(frame, &decoded); err != nil {
+				t.Fatalf("decoding the frame: %v", err)
+			}
+
+			assertJSON(t, decoded, expected.msgpack)
+		})
+	}
+}
+
+func TestMarshalInvalidLevel(t *testing.T) {
+	message := &dtos.Message{Type: dtos.TypeSnapshot, Symbol: "BTCUSDT", Data: &dtos.Snapshot{
+		Bids: [][]string{{"65000", "not a number"}},
+	}}
+
+	for _, e := range []Encoding{MsgPack, Protobuf} {
+		if _, err := e.Marshal(message); err == nil {
+			t.Errorf("%s.Marshal() error = nil, want an invalid quantity", e)
+		}
+	}
+}
+
+// assertJSON compares a decoded message with the expected JSON, the numbers being compared as float64.
+func assertJSON(t *testing.T, decoded any, expected string) {
+	t.Helper()
+
+	data, err := json.Marshal(decoded)
+	if err != nil {
+		t.Fatalf("encoding %v: %v", decoded, err)
+	}
+
+	var got, want any
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := json.Unmarshal([]byte(expected), &want); err != nil {
+		t.Fatalf("invalid expected JSON %s: %v", expected, err)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded message = %s\nwant %s", data, expected)
+	}
+}
@@ -0,0 +1,105 @@
+package encoding
+
+import (
+	"bytes"
+
+	"ob-manager/internal/dtos"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// msgpackBook is a snapshot with numeric price levels, each level being a [price, qty] array.
+type msgpackBook struct {
+	LastUpdateId int          `json:"lastUpdateId"`
+	Bids         [][2]float64 `json:"bids"`
+	Asks         [][2]float64 `json:"asks"`
+}
+
+// msgpackDelta is a depth update with numeric price levels.
+type msgpackDelta struct {
+	EventType     string       `json:"e"`
+	EventTime     int          `json:"E"`
+	Symbol        string       `json:"s"`
+	FirstUpdateId int          `json:"U"`
+	FinalUpdateId int          `json:"u"`
+	Bids          [][2]float64 `json:"b"`
+	Asks          [][2]float64 `json:"a"`
+}
+
+// msgpackBBO is the best bid and ask as numbers.
+type msgpackBBO struct {
+	BidPrice float64 `json:"bidPrice"`
+	BidQty   float64 `json:"bidQty"`
+	AskPrice float64 `json:"askPrice"`
+	AskQty   float64 `json:"askQty"`
+}
+
+// marshalMsgPack encodes the message as a MessagePack map with the keys of the JSON messages.
+// The price levels of the snapshots and deltas and the best bid and ask are numbers.
+func marshalMsgPack(message *dtos.Message) ([]byte, error) {
+	data, err := msgpackData(message.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	m := *message
+	m.Data = data
+
+	var buf bytes.Buffer
+
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+
+	if err := enc.Encode(&m); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func msgpackData(data any) (any, error) {
+	switch d := data.(type) {
+	case *dtos.Snapshot:
+		bids, err := levels(d.Bids)
+		if err != nil {
+			return nil, err
+		}
+
+		asks, err := levels(d.Asks)
+		if err != nil {
+			return nil, err
+		}
+
+		return &msgpackBook{LastUpdateId: d.LastUpdateId, Bids: bids, Asks: asks}, nil
+	case *dtos.EventUpdate:
+		bids, err := levels(d.Bids)
+		if err != nil {
+			return nil, err
+		}
+
+		asks, err := levels(d.Asks)
+		if err != nil {
+			return nil, err
+		}
+
+		return &msgpackDelta{
+			EventType:     d.EventType,
+			EventTime:     d.EventTime,
+			Symbol:        d.Symbol,
+			FirstUpdateId: d.FirstUpdateId,
+			FinalUpdateId: d.FinalUpdateId,
+			Bids:          bids,
+			Asks:          asks,
+		}, nil
+	case dtos.BBO:
+		b, err := bbo(d)
+		if err != nil {
+			return nil, err
+		}
+
+		return &msgpackBBO{BidPrice: b[0], BidQty: b[1], AskPrice: b[2], AskQty: b[3]}, nil
+	default:
+		return data, nil
+	}
+}
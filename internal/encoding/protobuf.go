@@ -0,0 +1,197 @@
+package encoding
+
+import (
+	"fmt"
+	"math"
+
+	"ob-manager/internal/dtos"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers of the Envelope message of api/downstream.proto.
+const (
+	envelopeType      protowire.Number = 1
+	envelopeSymbol    protowire.Number = 2
+	envelopeSeq       protowire.Number = 3
+	envelopePrevSeq   protowire.Number = 4
+	envelopeTs        protowire.Number = 5
+	envelopeSnapshot  protowire.Number = 10
+	envelopeDelta     protowire.Number = 11
+	envelopeBBO       protowire.Number = 12
+	envelopeAnalytics protowire.Number = 13
+	envelopeImpact    protowire.Number = 14
+	envelopeAck       protowire.Number = 15
+	envelopeResync    protowire.Number = 16
+	envelopeStatus    protowire.Number = 17
+	envelopeError     protowire.Number = 18
+)
+
+// marshalProtobuf encodes the message as an Envelope of api/downstream.proto.
+func marshalProtobuf(message *dtos.Message) ([]byte, error) {
+	b := appendString(nil, envelopeType, string(message.Type))
+	b = appendString(b, envelopeSymbol, message.Symbol)
+	b = appendInt(b, envelopeSeq, int64(message.Seq))
+	b = appendInt(b, envelopePrevSeq, int64(message.PrevSeq))
+	b = appendInt(b, envelopeTs, message.Ts)
+
+	return appendData(b, message.Data)
+}
+
+func appendData(b []byte, data any) ([]byte, error) {
+	switch d := data.(type) {
+	case nil:
+		return b, nil
+	case *dtos.Snapshot:
+		bids, err := levels(d.Bids)
+		if err != nil {
+			return nil, err
+		}
+
+		asks, err := levels(d.Asks)
+		if err != nil {
+			return nil, err
+		}
+
+		book := appendInt(nil, 1, int64(d.LastUpdateId))
+		book = appendLevels(book, 2, bids)
+		book = appendLevels(book, 3, asks)
+
+		return appendMessage(b, envelopeSnapshot, book), nil
+	case *dtos.EventUpdate:
+		bids, err := levels(d.Bids)
+		if err != nil {
+			return nil, err
+		}
+
+		asks, err := levels(d.Asks)
+		if err != nil {
+			return nil, err
+		}
+
+		delta := appendInt(nil, 1, int64(d.EventTime))
+		delta = appendInt(delta, 2, int64(d.FirstUpdateId))
+		delta = appendInt(delta, 3, int64(d.FinalUpdateId))
+		delta = appendLevels(delta, 4, bids)
+		delta = appendLevels(delta, 5, asks)
+
+		return appendMessage(b, envelopeDelta, delta), nil
+	case dtos.BBO:
+		numeric, err := bbo(d)
+		if err != nil {
+			return nil, err
+		}
+
+		var best []byte
+		for i, value := range numeric {
+			best = appendDouble(best, protowire.Number(i+1), value)
+		}
+
+		return appendMessage(b, envelopeBBO, best), nil
+	case *dtos.Analytics:
+		analytics := appendDouble(nil, 1, d.Mid)
+		analytics = appendDouble(analytics, 2, d.SpreadBps)
+		analytics = appendDouble(analytics, 3, d.Microprice)
+		analytics = appendDouble(analytics, 4, d.Imbalance)
+		analytics = appendInt(analytics, 5, int64(d.ImbalanceDepth))
+
+		for _, depth := range d.Depth {
+			band := appendDouble(nil, 1, depth.Bps)
+			band = appendDouble(band, 2, depth.BidNotional)
+			band = appendDouble(band, 3, depth.AskNotional)
+			analytics = appendMessage(analytics, 6, band)
+		}
+
+		return appendMessage(b, envelopeAnalytics, analytics), nil
+	case *dtos.Impact:
+		impact := appendString(nil, 1, d.Id)
+		impact = appendString(impact, 2, string(d.Side))
+		impact = appendDouble(impact, 3, d.Qty)
+		impact = appendDouble(impact, 4, d.FilledQty)
+		impact = appendDouble(impact, 5, d.Notional)
+		impact = appendDouble(impact, 6, d.Vwap)
+		impact = appendDouble(impact, 7, d.WorstPrice)
+		impact = appendInt(impact, 8, int64(d.LevelsConsumed))
+		impact = appendDouble(impact, 9, d.Mid)
+		impact = appendDouble(impact, 10, d.SlippageBps)
+		impact = appendBool(impact, 11, d.Complete)
+
+		return appendMessage(b, envelopeImpact, impact), nil
+	case dtos.SubscriptionAck:
+		ack := appendString(nil, 1, d.Symbol)
+		ack = appendString(ack, 2, d.Stream)
+
+		return appendMessage(b, envelopeAck, ack), nil
+	case dtos.ResyncNotice:
+		return appendMessage(b, envelopeResync, appendString(nil, 1, d.Reason)), nil
+	case dtos.StatusNotice:
+		return appendMessage(b, envelopeStatus, appendString(nil, 1, string(d.State))), nil
+	case dtos.ErrorMessage:
+		e := appendString(nil, 1, d.Code)
+		e = appendString(e, 2, d.Message)
+
+		return appendMessage(b, envelopeError, e), nil
+	default:
+		return nil, fmt.Errorf("no protobuf encoding for %T", data)
+	}
+}
+
+// appendLevels appends the price levels as repeated Level messages.
+func appendLevels(b []byte, num protowire.Number, levels [][2]float64) []byte {
+	for _, level := range levels {
+		l := appendDouble(nil, 1, level[0])
+		l = appendDouble(l, 2, level[1])
+		b = appendMessage(b, num, l)
+	}
+
+	return b
+}
+
+// appendMessage appends an embedded message, even an empty one so that the oneof field is set.
+func appendMessage(b []byte, num protowire.Number, message []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+
+	return protowire.AppendBytes(b, message)
+}
+
+// the scalar fields with their zero value are omitted, as in proto3.
+
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+
+	return protowire.AppendString(b, v)
+}
+
+func appendInt(b []byte, num protowire.Number, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+func appendDouble(b []byte, num protowire.Number, v float64) []byte {
+	if v == 0 {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+
+	return protowire.AppendFixed64(b, math.Float64bits(v))
+}
+
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+
+	return protowire.AppendVarint(b, 1)
+}
@@ -0,0 +1,296 @@
+package encoding
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode"
+
+	"ob-manager/internal/dtos"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const protoFile = "../../api/downstream.proto"
+
+// TestMarshalProtobuf decodes the frames with the Envelope message of api/downstream.proto and compares them to
+// the expected messages, in the JSON mapping of Protobuf. Fields of the wrong number or type are unknown fields
+// of the decoded message, which fail the comparison.
+func TestMarshalProtobuf(t *testing.T) {
+	envelope := loadEnvelope(t)
+
+	want := map[string]string{
+		"snapshot": `{"type":"snapshot","symbol":"BTCUSDT","seq":1000,"ts":1700000000000,"snapshot":{` +
+			`"lastUpdateId":1000,"bids":[{"price":65000.5,"qty":1.25},{"price":64999,"qty":3}],` +
+			`"asks":[{"price":65001,"qty":0.5}]}}`,
+		"delta": `{"type":"delta","symbol":"BTCUSDT","seq":1002,"prevSeq":1000,"ts":1700000000000,"delta":{` +
+			`"eventTime":1700000000000,"firstUpdateId":1001,"finalUpdateId":1002,"bids":[{"price":65000.5}],` +
+			`"asks":[{"price":65001,"qty":2.5},{"price":65002,"qty":1}]}}`,
+		"bbo": `{"type":"bbo","symbol":"BTCUSDT","seq":1002,"prevSeq":1000,"ts":1700000000000,` +
+			`"bbo":{"bidPrice":64999,"bidQty":3,"askPrice":65001,"askQty":2.5}}`,
+		"analytics": `{"type":"analytics","symbol":"BTCUSDT","seq":1002,"ts":1700000000000,"analytics":{` +
+			`"mid":65000,"spreadBps":0.3,"microprice":65000.9,"imbalance":0.09,"imbalanceDepth":10,` +
+			`"depth":[{"bps":10,"bidNotional":194997,"askNotional":227507.5}]}}`,
+		"impact": `{"type":"impact","symbol":"BTCUSDT","seq":1002,"ts":1700000000000,"impact":{"id":"42",` +
+			`"side":"buy","qty":3,"filledQty":3,"notional":195003.5,"vwap":65001.25,"worstPrice":65002,` +
+			`"levelsConsumed":2,"mid":65000,"slippageBps":0.19,"complete":true}}`,
+		"ack": `{"type":"subscribed","symbol":"BTCUSDT","ts":1700000000000,` +
+			`"ack":{"symbol":"BTCUSDT","stream":"depth"}}`,
+		"resync": `{"type":"resync","symbol":"BTCUSDT","ts":1700000000000,"resync":{"reason":"out of sequence"}}`,
+		"status": `{"type":"status","symbol":"BTCUSDT","seq":1002,"ts":1700000000000,"status":{"state":"stale"}}`,
+		"error": `{"type":"error","ts":1700000000000,` +
+			`"error":{"code":"unknown_symbol","message":"unknown symbol FOO"}}`,
+	}
+
+	for _, tm := range testMessages() {
+		t.Run(tm.name, func(t *testing.T) {
+			frame, err := Protobuf.Marshal(tm.message)
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+
+			got := dynamicpb.NewMessage(envelope)
+			if err := proto.Unmarshal(frame, got); err != nil {
+				t.Fatalf("decoding the frame: %v", err)
+			}
+
+			expected := dynamicpb.NewMessage(envelope)
+			if err := protojson.Unmarshal([]byte(want[tm.name]), expected); err != nil {
+				t.Fatalf("invalid expected message %s: %v", want[tm.name], err)
+			}
+
+			if !proto.Equal(got, expected) {
+				t.Errorf("decoded message = %v\nwant %v", got, expected)
+			}
+		})
+	}
+}
+
+// TestMarshalProtobufEmptyPayload checks that an empty payload still sets its field of the oneof.
+func TestMarshalProtobufEmptyPayload(t *testing.T) {
+	envelope := loadEnvelope(t)
+
+	frame, err := Protobuf.Marshal(&dtos.Message{Type: dtos.TypeResync, Data: dtos.ResyncNotice{}})
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+
+	got := dynamicpb.NewMessage(envelope)
+	if err := proto.Unmarshal(frame, got); err != nil {
+		t.Fatalf("decoding the frame: %v", err)
+	}
+
+	oneof := got.WhichOneof(envelope.Oneofs().ByName("data"))
+	if oneof == nil || oneof.Name() != "resync" {
+		t.Errorf("data field = %v, want resync", oneof)
+	}
+}
+
+// loadEnvelope returns the descriptor of the Envelope message of api/downstream.proto.
+func loadEnvelope(t *testing.T) protoreflect.MessageDescriptor {
+	t.Helper()
+
+	source, err := os.ReadFile(protoFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fileProto, err := parseProto(protoFile, string(source))
+	if err != nil {
+		t.Fatalf("parsing %s: %v", protoFile, err)
+	}
+
+	file, err := protodesc.NewFile(fileProto, nil)
+	if err != nil {
+		t.Fatalf("building the descriptor of %s: %v", protoFile, err)
+	}
+
+	envelope := file.Messages().ByName("Envelope")
+	if envelope == nil {
+		t.Fatalf("no Envelope message in %s", protoFile)
+	}
+
+	return envelope
+}
+
+// scalarTypes are the field types of the proto file other than the messages.
+var scalarTypes = map[string]descriptorpb.FieldDescriptorProto_Type{
+	"string": descriptorpb.FieldDescriptorProto_TYPE_STRING,
+	"bool":   descriptorpb.FieldDescriptorProto_TYPE_BOOL,
+	"int32":  descriptorpb.FieldDescriptorProto_TYPE_INT32,
+	"int64":  descriptorpb.FieldDescriptorProto_TYPE_INT64,
+	"double": descriptorpb.FieldDescriptorProto_TYPE_DOUBLE,
+}
+
+// parseProto parses the subset of the proto3 language used by api/downstream.proto: messages of scalar, message
+// and repeated fields, and oneofs. There is no protoc in the build, so the descriptor is built from the source.
+func parseProto(name, source string) (*descriptorpb.FileDescriptorProto, error) {
+	p := &protoParser{tokens: tokenize(source)}
+	file := &descriptorpb.FileDescriptorProto{Name: proto.String(name)}
+
+	for !p.done() {
+		switch token := p.next(); token {
+		case "syntax":
+			p.expect("=")
+			file.Syntax = proto.String(strings.Trim(p.next(), `"`))
+			p.expect(";")
+		case "package":
+			file.Package = proto.String(p.next())
+			p.expect(";")
+		case "message":
+			file.MessageType = append(file.MessageType, p.message(file.GetPackage()))
+		default:
+			p.fail("unexpected %q", token)
+		}
+	}
+
+	return file, p.err
+}
+
+type protoParser struct {
+	tokens []string
+	pos    int
+	err    error
+}
+
+func (p *protoParser) done() bool {
+	return p.err != nil || p.pos >= len(p.tokens)
+}
+
+func (p *protoParser) next() string {
+	if p.done() {
+		p.fail("unexpected end of file")
+
+		return ""
+	}
+
+	p.pos++
+
+	return p.tokens[p.pos-1]
+}
+
+func (p *protoParser) peek() string {
+	if p.done() {
+		return ""
+	}
+
+	return p.tokens[p.pos]
+}
+
+func (p *protoParser) expect(token string) {
+	if got := p.next(); got != token {
+		p.fail("expected %q, got %q", token, got)
+	}
+}
+
+func (p *protoParser) fail(format string, args ...any) {
+	if p.err == nil {
+		p.err = fmt.Errorf(format, args...)
+	}
+}
+
+// message parses the body of a message, after the message keyword.
+func (p *protoParser) message(pkg string) *descriptorpb.DescriptorProto {
+	message := &descriptorpb.DescriptorProto{Name: proto.String(p.next())}
+	p.expect("{")
+
+	for !p.done() && p.peek() != "}" {
+		if p.peek() != "oneof" {
+			message.Field = append(message.Field, p.field(pkg))
+
+			continue
+		}
+
+		p.next()
+		oneof := int32(len(message.OneofDecl))
+		message.OneofDecl = append(message.OneofDecl, &descriptorpb.OneofDescriptorProto{Name: proto.String(p.next())})
+		p.expect("{")
+
+		for !p.done() && p.peek() != "}" {
+			field := p.field(pkg)
+			field.OneofIndex = proto.Int32(oneof)
+			message.Field = append(message.Field, field)
+		}
+
+		p.expect("}")
+	}
+
+	p.expect("}")
+
+	return message
+}
+
+// field parses a field: [repeated] type name = number;
+func (p *protoParser) field(pkg string) *descriptorpb.FieldDescriptorProto {
+	field := &descriptorpb.FieldDescriptorProto{
+		Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+	}
+
+	typeName := p.next()
+	if typeName == "repeated" {
+		field.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+		typeName = p.next()
+	}
+
+	if scalar, ok := scalarTypes[typeName]; ok {
+		field.Type = scalar.Enum()
+	} else {
+		field.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+		field.TypeName = proto.String("." + pkg + "." + typeName)
+	}
+
+	field.Name = proto.String(p.next())
+	p.expect("=")
+
+	number, err := strconv.Atoi(p.next())
+	if err != nil {
+		p.fail("invalid number of field %s: %v", field.GetName(), err)
+	}
+
+	field.Number = proto.Int32(int32(number))
+	p.expect(";")
+
+	return field
+}
+
+// tokenize splits the source into identifiers, numbers, strings and punctuation, skipping the comments.
+func tokenize(source string) []string {
+	var tokens []string
+
+	for line := range strings.Lines(source) {
+		line, _, _ = strings.Cut(line, "//")
+
+		for i := 0; i < len(line); {
+			r := rune(line[i])
+
+			switch {
+			case unicode.IsSpace(r):
+				i++
+			case r == '"':
+				end := strings.IndexByte(line[i+1:], '"') + i + 2
+				tokens = append(tokens, line[i:end])
+				i = end
+			case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.':
+				start := i
+				for i < len(line) && (unicode.IsLetter(rune(line[i])) || unicode.IsDigit(rune(line[i])) ||
+					line[i] == '_' || line[i] == '.') {
+					i++
+				}
+
+				tokens = append(tokens, line[start:i])
+			default:
+				tokens = append(tokens, string(r))
+				i++
+			}
+		}
+	}
+
+	return tokens
+}
@@ -0,0 +1,65 @@
+package feed
+
+import (
+	tree "github.com/emirpasic/gods/trees/redblacktree"
+)
+
+// NewBids returns an empty bid side of an order book, the quantities keyed by price in descending order.
+func NewBids() *tree.Tree {
+	return tree.NewWith(bidComparator)
+}
+
+// NewAsks returns an empty ask side of an order book, the quantities keyed by price in ascending order.
+func NewAsks() *tree.Tree {
+	return tree.NewWith(askComparator)
+}
+
+// PutLevel updates a price level of a side. A zero quantity removes the level.
+func PutLevel(side *tree.Tree, price, qty float64) {
+	if qty == 0 {
+		side.Remove(price)
+
+		return
+	}
+
+	side.Put(price, qty)
+}
+
+// TopLevels returns the first depth levels of a side in the book order, converted by level. A depth of 0 returns
+// all the levels.
+func TopLevels[T any](side *tree.Tree, depth int, level func(price, qty float64) T) []T {
+	size := side.Size()
+	if depth > 0 {
+		size = min(size, depth)
+	}
+
+	levels := make([]T, 0, size)
+	it := side.Iterator()
+
+	for len(levels) < size && it.Next() {
+		levels = append(levels, level(it.Key().(float64), it.Value().(float64)))
+	}
+
+	return levels
+}
+
+// askComparator to sort asks.
+func askComparator(a, b interface{}) int {
+	return compareFloats(a.(float64), b.(float64))
+}
+
+// bidComparator to sort bids.
+func bidComparator(a, b interface{}) int {
+	return compareFloats(b.(float64), a.(float64))
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,112 @@
+// Package feed holds the parts of the order book feeds shared by the in-process engine, the client and the
+// processors: the streams and the delivery of their updates to the subscriptions, and the sides of the order books.
+package feed
+
+import (
+	"errors"
+	"sync"
+)
+
+// Stream of a currency pair a subscription receives.
+type Stream string
+
+const (
+	Depth     Stream = "depth"
+	BBO       Stream = "bbo"
+	Analytics Stream = "analytics"
+)
+
+// ErrSlowConsumer closes the channel subscriptions whose buffer is full.
+var ErrSlowConsumer = errors.New("subscription buffer full")
+
+// Sink delivers the updates of a subscription to its channel or to its callback.
+type Sink[T any] struct {
+	// c receives the updates of the channel subscriptions and fn is called with the updates
+	// of the callback subscriptions.
+	c  chan T
+	fn func(T)
+
+	mu     sync.Mutex
+	closed bool
+	err    error
+}
+
+// NewChan returns a sink buffering up to buffer updates in its channel.
+func NewChan[T any](buffer int) *Sink[T] {
+	return &Sink[T]{c: make(chan T, buffer)}
+}
+
+// NewFunc returns a sink calling fn with the updates.
+func NewFunc[T any](fn func(T)) *Sink[T] {
+	return &Sink[T]{fn: fn}
+}
+
+// C returns the channel of the updates. It is closed with the sink and nil for the callback sinks.
+func (s *Sink[T]) C() <-chan T {
+	return s.c
+}
+
+// Err returns the reason the sink was closed with, nil while it is open.
+func (s *Sink[T]) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+// Close stops the delivery of the updates and closes the channel. The first reason is kept.
+func (s *Sink[T]) Close(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closeLocked(err)
+}
+
+func (s *Sink[T]) closeLocked(err error) {
+	if s.closed {
+		return
+	}
+
+	s.closed = true
+	s.err = err
+
+	if s.c != nil {
+		close(s.c)
+	}
+}
+
+func (s *Sink[T]) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closed
+}
+
+// Deliver sends the update to the subscriber. A channel whose buffer is full is closed and Deliver returns
+// ErrSlowConsumer, so that the caller drops the subscription.
+func (s *Sink[T]) Deliver(update T) error {
+	if s.fn != nil {
+		// the callback may close the subscription, so it is called without the lock
+		if !s.isClosed() {
+			s.fn(update)
+		}
+
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	select {
+	case s.c <- update:
+		return nil
+	default:
+		s.closeLocked(ErrSlowConsumer)
+
+		return ErrSlowConsumer
+	}
+}
@@ -0,0 +1,61 @@
+// Package lifecycle runs the components of the service in an errgroup and stops them in order.
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Component is a subsystem running until its context is done. It returns an error when it fails.
+type Component interface {
+	Run(ctx context.Context) error
+}
+
+// Service is a component running in an errgroup. Each service has its own context, so that
+// the shutdown stops the services in order.
+type Service struct {
+	name   string
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Start runs the component in the group. A component returning before it is stopped fails the group,
+// which cancels the context of the group and starts the shutdown.
+func Start(g *errgroup.Group, name string, c Component) *Service {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := &Service{
+		name:   name,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	g.Go(func() error {
+		defer close(s.done)
+
+		err := c.Run(ctx)
+
+		switch {
+		case err != nil:
+			return fmt.Errorf("%s: %w", name, err)
+		case ctx.Err() == nil:
+			return fmt.Errorf("%s stopped unexpectedly", name)
+		default:
+			return nil
+		}
+	})
+
+	return s
+}
+
+// Stop cancels the service and waits for it to return. A nil service is not running.
+func (s *Service) Stop() {
+	if s == nil {
+		return
+	}
+
+	s.cancel()
+	<-s.done
+}
@@ -0,0 +1,167 @@
+// Package metrics exposes the Prometheus metrics of the order book pipeline.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	namespace = "obmanager"
+
+	InQueue, OutQueue = "in", "out"
+)
+
+var (
+	UpstreamConnected = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "upstream_connected",
+		Help:      "1 if the upstream websocket is connected.",
+	})
+
+	UpstreamReconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_reconnects_total",
+		Help:      "Number of upstream websocket reconnections.",
+	})
+
+	UpstreamMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_messages_total",
+		Help:      "Number of depth updates received from the upstream per symbol.",
+	}, []string{"symbol"})
+
+	DiscardedEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "discarded_events_total",
+		Help:      "Number of depth updates discarded as older than the order book.",
+	}, []string{"symbol"})
+
+	ApplyLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "processor_apply_seconds",
+		Help:      "Time to apply a depth update to the order book.",
+		Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 8),
+	}, []string{"symbol"})
+
+	PushLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "event_push_latency_seconds",
+		Help:      "Time from the upstream event time to the push of the update to the subscribers.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"symbol"})
+
+	BookLevels = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "book_levels",
+		Help:      "Number of price levels of the order book per side.",
+	}, []string{"symbol", "side"})
+
+	Subscribers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "subscribers",
+		Help:      "Number of downstream subscriptions per symbol.",
+	}, []string{"symbol"})
+
+	QueueOverflows = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queue_overflows_total",
+		Help:      "Number of messages added to a full queue per queue, symbol and overflow policy.",
+	}, []string{"queue", "symbol", "policy"})
+
+	WSWriteErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ws_write_errors_total",
+		Help:      "Number of failed writes to the downstream websockets.",
+	})
+
+	SlowConsumers = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "slow_consumers_total",
+		Help:      "Number of downstream connections closed because their send buffer was full.",
+	})
+
+	IdleDisconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "idle_disconnects_total",
+		Help:      "Number of downstream connections closed because they sent no message or pong within the idle timeout.",
+	})
+
+	RejectedConnections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rejected_connections_total",
+		Help:      "Number of downstream connections rejected by a quota.",
+	}, []string{"reason"})
+
+	ThrottledCommands = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "throttled_commands_total",
+		Help:      "Number of downstream commands rejected by a limit.",
+	}, []string{"reason"})
+
+	ThrottledDisconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "throttled_disconnects_total",
+		Help:      "Number of downstream connections closed after too many rejected commands.",
+	})
+
+	WSPayloadBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ws_payload_bytes_total",
+		Help:      "Bytes of the messages written to the downstream websockets, before compression.",
+	})
+
+	WSWireBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ws_wire_bytes_total",
+		Help:      "Bytes written to the downstream connections, after compression and framing.",
+	})
+
+	WSCompressionRatio = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "ws_connection_compression_ratio",
+		Help:      "Ratio of the wire bytes to the payload bytes written to each closed downstream connection.",
+		Buckets:   prometheus.LinearBuckets(0.1, 0.1, 12),
+	})
+)
+
+type InQLengths interface {
+	Lengths() map[string]int
+}
+
+type OutQLength interface {
+	Length() int
+}
+
+// queueCollector reports the occupancy of the in-queues per symbol and of the out-queue on each scrape.
+type queueCollector struct {
+	inQueues InQLengths
+	outQueue OutQLength
+	inQ      *prometheus.Desc
+	outQ     *prometheus.Desc
+}
+
+// RegisterQueues registers the collector of the queue occupancy.
+func RegisterQueues(inQueues InQLengths, outQueue OutQLength) {
+	prometheus.MustRegister(&queueCollector{
+		inQueues: inQueues,
+		outQueue: outQueue,
+		inQ: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "inqueue_length"),
+			"Number of depth updates waiting in the in-queue of a symbol.", []string{"symbol"}, nil),
+		outQ: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "outqueue_length"),
+			"Number of messages waiting in the out-queue.", nil, nil),
+	})
+}
+
+func (c *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.inQ
+	ch <- c.outQ
+}
+
+func (c *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	for symbol, length := range c.inQueues.Lengths() {
+		ch <- prometheus.MustNewConstMetric(c.inQ, prometheus.GaugeValue, float64(length), symbol)
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.outQ, prometheus.GaugeValue, float64(c.outQueue.Length()))
+}
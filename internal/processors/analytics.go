@@ -0,0 +1,81 @@
+package processors
+
+import (
+	"ob-manager/internal/dtos"
+
+	tree "github.com/emirpasic/gods/trees/redblacktree"
+)
+
+const bpsFactor = 10000
+
+// Analytics computes the metrics of the order book, the imbalance of the best imbalanceDepth levels on each side
+// and the cumulative notionals within each of the depthBands basis points of the mid price.
+func (ob *OrderBook) Analytics(imbalanceDepth int, depthBands []float64) (*dtos.Analytics, int) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	analytics := &dtos.Analytics{
+		ImbalanceDepth: imbalanceDepth,
+		Depth:          make([]dtos.DepthAtBps, 0, len(depthBands)),
+	}
+
+	bid, ask := ob.Bids.Left(), ob.Asks.Left()
+	if bid == nil || ask == nil {
+		return analytics, ob.lastUpdateId
+	}
+
+	bidPrice, bidQty := bid.Key.(float64), bid.Value.(float64)
+	askPrice, askQty := ask.Key.(float64), ask.Value.(float64)
+
+	mid := (bidPrice + askPrice) / 2
+
+	analytics.Mid = mid
+	analytics.SpreadBps = (askPrice - bidPrice) / mid * bpsFactor
+	analytics.Microprice = (bidPrice*askQty + askPrice*bidQty) / (bidQty + askQty)
+
+	bidDepthQty, askDepthQty := sideQty(ob.Bids, imbalanceDepth), sideQty(ob.Asks, imbalanceDepth)
+	if total := bidDepthQty + askDepthQty; total > 0 {
+		analytics.Imbalance = (bidDepthQty - askDepthQty) / total
+	}
+
+	for _, bps := range depthBands {
+		analytics.Depth = append(analytics.Depth, dtos.DepthAtBps{
+			Bps:         bps,
+			BidNotional: sideNotional(ob.Bids, mid*(1-bps/bpsFactor), func(price, limit float64) bool { return price >= limit }),
+			AskNotional: sideNotional(ob.Asks, mid*(1+bps/bpsFactor), func(price, limit float64) bool { return price <= limit }),
+		})
+	}
+
+	return analytics, ob.lastUpdateId
+}
+
+// sideQty sums the quantities of the best depth levels of a side.
+func sideQty(side *tree.Tree, depth int) float64 {
+	var qty float64
+
+	it := side.Iterator()
+
+	for i := 0; i < depth && it.Next(); i++ {
+		qty += it.Value().(float64)
+	}
+
+	return qty
+}
+
+// sideNotional sums the notional of the levels of a side until the price is out of the limit.
+func sideNotional(side *tree.Tree, limit float64, within func(price, limit float64) bool) float64 {
+	var notional float64
+
+	it := side.Iterator()
+
+	for it.Next() {
+		price := it.Key().(float64)
+		if !within(price, limit) {
+			break
+		}
+
+		notional += price * it.Value().(float64)
+	}
+
+	return notional
+}
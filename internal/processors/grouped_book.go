@@ -0,0 +1,88 @@
+package processors
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"ob-manager/internal/dtos"
+
+	tree "github.com/emirpasic/gods/trees/redblacktree"
+)
+
+const (
+	// bucketEpsilon absorbs the float error of prices lying exactly on a bucket boundary.
+	bucketEpsilon = 1e-9
+	qtyPrecision  = 1e8
+)
+
+// Grouped returns a snapshot of the order book aggregated to price buckets of the given step.
+// Bids are rounded down and asks are rounded up to the bucket price. A depth greater than 0 limits the
+// number of buckets on each side.
+func (ob *OrderBook) Grouped(step float64, depth int) *dtos.Snapshot {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	decimals := stepDecimals(step)
+
+	return &dtos.Snapshot{
+		LastUpdateId: ob.lastUpdateId,
+		Bids: groupLevels(ob.Bids, depth, decimals, func(price float64) float64 {
+			return math.Floor(price/step+bucketEpsilon) * step
+		}),
+		Asks: groupLevels(ob.Asks, depth, decimals, func(price float64) float64 {
+			return math.Ceil(price/step-bucketEpsilon) * step
+		}),
+	}
+}
+
+// groupLevels sums the quantities of a side per bucket, walking the side in the book order.
+func groupLevels(side *tree.Tree, depth, decimals int, bucket func(float64) float64) [][]string {
+	levels := make([][]string, 0)
+	it := side.Iterator()
+
+	var (
+		bucketPrice float64
+		bucketQty   float64
+	)
+
+	appendBucket := func() {
+		levels = append(levels, []string{
+			strconv.FormatFloat(bucketPrice, 'f', decimals, 64),
+			formatFloat(math.Round(bucketQty*qtyPrecision) / qtyPrecision),
+		})
+	}
+
+	for it.Next() {
+		price := bucket(it.Key().(float64))
+
+		if bucketQty > 0 && price != bucketPrice {
+			appendBucket()
+
+			if depth > 0 && len(levels) == depth {
+				return levels
+			}
+
+			bucketQty = 0
+		}
+
+		bucketPrice = price
+		bucketQty += it.Value().(float64)
+	}
+
+	if bucketQty > 0 {
+		appendBucket()
+	}
+
+	return levels
+}
+
+// stepDecimals returns the number of decimals to format the bucket prices of a step.
+func stepDecimals(step float64) int {
+	_, decimals, found := strings.Cut(formatFloat(step), ".")
+	if !found {
+		return 0
+	}
+
+	return len(decimals)
+}
@@ -0,0 +1,54 @@
+package processors
+
+import (
+	"ob-manager/internal/dtos"
+)
+
+// Impact walks the opposite side of the book to estimate the fill of a market order of the given quantity.
+// Buy orders consume the asks and sell orders consume the bids.
+func (ob *OrderBook) Impact(side dtos.Side, qty float64) (*dtos.Impact, int) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	impact := &dtos.Impact{
+		Side: side,
+		Qty:  qty,
+	}
+
+	levels := ob.Asks
+	if side == dtos.SideSell {
+		levels = ob.Bids
+	}
+
+	bid, ask := ob.Bids.Left(), ob.Asks.Left()
+	if bid != nil && ask != nil {
+		impact.Mid = (bid.Key.(float64) + ask.Key.(float64)) / 2
+	}
+
+	it := levels.Iterator()
+
+	for impact.FilledQty < qty && it.Next() {
+		price := it.Key().(float64)
+		fillQty := min(it.Value().(float64), qty-impact.FilledQty)
+
+		impact.FilledQty += fillQty
+		impact.Notional += price * fillQty
+		impact.WorstPrice = price
+		impact.LevelsConsumed++
+	}
+
+	impact.Complete = impact.FilledQty >= qty
+
+	if impact.FilledQty > 0 {
+		impact.Vwap = impact.Notional / impact.FilledQty
+	}
+
+	if impact.Mid > 0 && impact.Vwap > 0 {
+		impact.SlippageBps = (impact.Vwap - impact.Mid) / impact.Mid * bpsFactor
+		if side == dtos.SideSell {
+			impact.SlippageBps = -impact.SlippageBps
+		}
+	}
+
+	return impact, ob.lastUpdateId
+}
@@ -1,37 +1,105 @@
 package processors
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"log/slog"
+	"maps"
+	"ob-manager/internal/dtos"
 	inqueues "ob-manager/internal/queues/in"
 	outqueues "ob-manager/internal/queues/out"
+	"slices"
 	"sync"
+	"time"
 )
 
+const (
+	monitorInterval = 1 * time.Second
+	resyncQueueSize = 100
+)
+
+var (
+	ErrUnknownSymbol = errors.New("unknown symbol")
+	ErrNotSynced     = errors.New("order book is not synced")
+)
+
+// StaleThresholds configure when an order book is stale.
+type StaleThresholds struct {
+	// StaleAfter is the maximum wall-clock time since the last event applied.
+	StaleAfter time.Duration
+	// MaxEventLag is the maximum delay between the event time and its reception.
+	MaxEventLag time.Duration
+}
+
+// AnalyticsSettings configure the metrics derived from the order books.
+type AnalyticsSettings struct {
+	// Interval is the minimum time between two analytics messages of a currency pair. 0 publishes after each update.
+	Interval time.Duration
+	// ImbalanceDepth is the number of levels on each side used for the order book imbalance.
+	ImbalanceDepth int
+	// DepthBands are the distances from the mid price in basis points of the cumulative notionals.
+	DepthBands []float64
+}
+
+// ResyncRequest asks the upstream client to fetch a new snapshot for a currency pair.
+type ResyncRequest struct {
+	Symbol string
+	Reason string
+}
+
 type Manager struct {
-	inQ  *inqueues.InQManager
-	outQ *outqueues.Queue
+	inQ        *inqueues.InQManager
+	outQ       *outqueues.Queue
+	thresholds StaleThresholds
+	analytics  AnalyticsSettings
+	resyncs    chan ResyncRequest
 
 	mu         sync.RWMutex
 	processors map[string]*Processor
 }
 
-func NewManager(inQ *inqueues.InQManager, outQ *outqueues.Queue) *Manager {
+// NewManager creates the manager of the order book processors. The books are monitored by Run.
+func NewManager(inQ *inqueues.InQManager, outQ *outqueues.Queue, thresholds StaleThresholds,
+	analytics AnalyticsSettings) *Manager {
 	return &Manager{
 		inQ:        inQ,
 		outQ:       outQ,
+		thresholds: thresholds,
+		analytics:  analytics,
+		resyncs:    make(chan ResyncRequest, resyncQueueSize),
 		processors: make(map[string]*Processor),
 	}
 }
 
-func (m *Manager) StartProcessor(currency string) {
+// Run monitors the order books until the context is done, then stops the processors.
+// The events left in the in-queues are not applied.
+func (m *Manager) Run(ctx context.Context) error {
+	m.monitorBooks(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// the processors are kept for the snapshots still in flight
+	for _, p := range m.processors {
+		p.stopProcessor()
+	}
+
+	slog.Info("Processors Stopped")
+
+	return nil
+}
+
+// StartProcessor starts the processor of a currency pair, waiting for the snapshot of its order book.
+func (m *Manager) StartProcessor(currency string) *Processor {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	proc := NewProcessor(currency, m.inQ, m.outQ)
+	proc := NewProcessor(currency, m.inQ, m.outQ, m.analytics)
 	m.processors[currency] = proc
 
 	go proc.startProcessor()
+
+	return proc
 }
 
 func (m *Manager) Processor(currency string) *Processor {
@@ -41,43 +109,231 @@ func (m *Manager) Processor(currency string) *Processor {
 	return m.processors[currency]
 }
 
-// GetOrderBook parses the order book to a JSON to send to the subscriber.
-func (m *Manager) GetOrderBook(curr string) ([]byte, int) {
+// readyProcessor returns the processor of a currency pair whose order book is synced.
+func (m *Manager) readyProcessor(currency string) (*Processor, error) {
+	proc := m.Processor(currency)
+	if proc == nil {
+		return nil, ErrUnknownSymbol
+	}
+
+	if !proc.IsReady() {
+		return nil, ErrNotSynced
+	}
+
+	return proc, nil
+}
+
+// Symbols returns the sorted currency pairs with a processor.
+func (m *Manager) Symbols() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return slices.Sorted(maps.Keys(m.processors))
+}
+
+// GetOrderBook returns a snapshot of the order book to send to the subscriber.
+// A depth greater than 0 limits the snapshot to the best depth levels on each side.
+func (m *Manager) GetOrderBook(curr string, depth int) (*dtos.Snapshot, error) {
+	proc, err := m.readyProcessor(curr)
+	if err != nil {
+		return nil, err
+	}
+
+	return proc.OrderBook().TopN(depth), nil
+}
+
+// GetGroupedOrderBook returns a snapshot of the order book aggregated to price buckets of the given step.
+// A depth greater than 0 limits the snapshot to the best depth buckets on each side.
+func (m *Manager) GetGroupedOrderBook(curr string, step float64, depth int) (*dtos.Snapshot, error) {
+	proc, err := m.readyProcessor(curr)
+	if err != nil {
+		return nil, err
+	}
+
+	return proc.OrderBook().Grouped(step, depth), nil
+}
+
+// GetAnalytics returns the latest analytics message of the order book. It is nil until the first update.
+func (m *Manager) GetAnalytics(curr string) (*dtos.Message, error) {
+	proc, err := m.readyProcessor(curr)
+	if err != nil {
+		return nil, err
+	}
+
+	return proc.Analytics(), nil
+}
+
+// BookStatus returns the sync state of the order book of a currency pair.
+// A currency pair without a processor is syncing, as its processor is (re)started with the upstream connection.
+func (m *Manager) BookStatus(curr string) dtos.SymbolStatus {
 	proc := m.Processor(curr)
-	ob := proc.OrderBook()
-	snapshot := ob.Snapshot()
-	lastUpdateId := snapshot.LastUpdateId
+	if proc == nil {
+		return dtos.SymbolStatus{Symbol: curr, State: dtos.BookSyncing, LastEventAgeMs: -1}
+	}
+
+	return proc.Status(time.Now(), m.thresholds)
+}
+
+// GetBBO returns the best bid and ask of the order book with its last update id.
+func (m *Manager) GetBBO(curr string) (*dtos.BBO, int, error) {
+	proc, err := m.readyProcessor(curr)
+	if err != nil {
+		return nil, 0, err
+	}
 
-	jsonStr, err := json.Marshal(snapshot)
+	bbo, lastUpdateId := proc.OrderBook().BBO()
+
+	return &bbo, lastUpdateId, nil
+}
+
+// GetImpact estimates the fill of a market order of the given quantity against the order book.
+func (m *Manager) GetImpact(curr string, side dtos.Side, qty float64) (*dtos.Impact, int, error) {
+	proc, err := m.readyProcessor(curr)
 	if err != nil {
-		slog.Error("error on parsing order book to json", "Err", err)
+		return nil, 0, err
 	}
 
-	return jsonStr, lastUpdateId
+	impact, lastUpdateId := proc.OrderBook().Impact(side, qty)
+
+	return impact, lastUpdateId, nil
 }
 
-// UpdateBids updates the bids from the snapshot.
-func (m *Manager) UpdateBids(currency string, bids map[float64]float64) {
-	m.Processor(currency).ob.updateBids(bids)
+// RestartProcessor replaces the processor of a currency pair with an empty order book waiting for a new snapshot.
+// The subscribers are notified to resync as they will receive a new snapshot.
+// The resync message is queued after releasing the lock, as the push workers take it for the snapshots and a full
+// out-queue blocks until they make room. It returns the new processor.
+func (m *Manager) RestartProcessor(currency, reason string) *Processor {
+	m.mu.Lock()
+
+	if p, ok := m.processors[currency]; ok {
+		p.stopProcessor()
+		slog.Info("Processor Stopped.", "Currency", currency, "Reason", reason)
+	}
+
+	proc := NewProcessor(currency, m.inQ, m.outQ, m.analytics)
+	m.processors[currency] = proc
+
+	go proc.startProcessor()
+
+	m.mu.Unlock()
+
+	m.outQ.AddToOutQ(resyncMessage(currency, reason))
+
+	return proc
 }
 
-// UpdateAsks updates the asks from the snapshot.
-func (m *Manager) UpdateAsks(currency string, asks map[float64]float64) {
-	m.Processor(currency).ob.updateAsks(asks)
+// resyncMessage returns the message asking the subscribers of a currency pair to wait for a new snapshot.
+func resyncMessage(currency, reason string) *dtos.Message {
+	return &dtos.Message{
+		Type:   dtos.TypeResync,
+		Symbol: currency,
+		Ts:     time.Now().UnixMilli(),
+		Data:   dtos.ResyncNotice{Reason: reason},
+	}
 }
 
-// SetOrderBookReady marks the order book is populated and ready to process push events.
-func (m *Manager) SetOrderBookReady(currency string, lastUpdateId int) {
-	m.Processor(currency).SetReady(lastUpdateId)
+// RequestResync asks the upstream client to resync the order book of a currency pair.
+// The request is dropped if a lot of requests are already pending.
+func (m *Manager) RequestResync(currency, reason string) {
+	select {
+	case m.resyncs <- ResyncRequest{Symbol: currency, Reason: reason}:
+		slog.Info("Resync Requested.", "Currency", currency, "Reason", reason)
+	default:
+		slog.Error("Resync Request Dropped.", "Currency", currency, "Reason", reason)
+	}
+}
+
+// ResyncRequests returns the pending resync requests.
+func (m *Manager) ResyncRequests() <-chan ResyncRequest {
+	return m.resyncs
+}
+
+// monitorBooks checks the sync state of the order books, notifies the subscribers when it changes
+// and requests a resync of the stale, out of sequence and stuck syncing books, at most once per StaleAfter.
+// The books whose events were dropped by the in-queue are resynced right away, unless they were resynced within
+// StaleAfter: a sustained overflow would otherwise request a snapshot for each dropped event. A book still
+// dropping events after its resync falls out of sequence, and is resynced again once StaleAfter is over.
+func (m *Manager) monitorBooks(ctx context.Context) {
+	ticker := time.NewTicker(monitorInterval)
+	defer ticker.Stop()
+
+	states := make(map[*Processor]dtos.BookState)
+	lastResync := make(map[string]time.Time)
+
+	for {
+		var now time.Time
+
+		select {
+		case <-ctx.Done():
+			return
+		case symbol := <-m.inQ.Overflows():
+			if now := time.Now(); now.Sub(lastResync[symbol]) > m.thresholds.StaleAfter {
+				lastResync[symbol] = now
+				m.RequestResync(symbol, "in-queue overflow")
+			}
+
+			continue
+		case now = <-ticker.C:
+		}
+
+		m.mu.RLock()
+		procs := slices.Collect(maps.Values(m.processors))
+		m.mu.RUnlock()
+
+		live := make(map[*Processor]dtos.BookState, len(procs))
+
+		for _, p := range procs {
+			status := p.Status(now, m.thresholds)
+			live[p] = status.State
+
+			if prev, ok := states[p]; (ok && prev != status.State) || (!ok && status.State != dtos.BookSyncing) {
+				slog.Info("Order Book State Changed.", "Currency", p.currency, "State", status.State)
+
+				m.outQ.AddToOutQ(&dtos.Message{
+					Type:   dtos.TypeStatus,
+					Symbol: p.currency,
+					Seq:    status.LastUpdateId,
+					Ts:     now.UnixMilli(),
+					Data:   dtos.StatusNotice{State: status.State},
+				})
+			}
+
+			stuck := status.State == dtos.BookSyncing && now.Sub(p.created) > m.thresholds.StaleAfter
+			if status.State != dtos.BookStale && status.State != dtos.BookOutOfSequence && !stuck {
+				continue
+			}
+
+			if now.Sub(lastResync[p.currency]) > m.thresholds.StaleAfter {
+				lastResync[p.currency] = now
+				m.RequestResync(p.currency, string(status.State))
+			}
+		}
+
+		states = live
+	}
 }
 
 // ResetProcessors clears all order books and prepares for a reconnection.
+// The subscribers are notified to resync as they will receive a new snapshot, after releasing the lock like
+// RestartProcessor.
 func (m *Manager) ResetProcessors() {
+	m.mu.Lock()
+
+	resyncs := make([]*dtos.Message, 0, len(m.processors))
+
 	for _, p := range m.processors {
 		p.stopProcessor()
 		slog.Info("Processor Stopped.", "Currency", p.currency)
+
+		resyncs = append(resyncs, resyncMessage(p.currency, "upstream reconnect"))
 	}
 
 	clear(m.processors)
+	m.mu.Unlock()
+
+	for _, message := range resyncs {
+		m.outQ.AddToOutQ(message)
+	}
+
 	slog.Info("Processors reset and Order Books Cleared")
 }
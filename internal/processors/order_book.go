@@ -2,6 +2,8 @@ package processors
 
 import (
 	"ob-manager/internal/dtos"
+	"ob-manager/internal/feed"
+	"strconv"
 	"sync"
 
 	tree "github.com/emirpasic/gods/trees/redblacktree"
@@ -16,34 +18,51 @@ type OrderBook struct {
 
 func NewOrderBook() *OrderBook {
 	return &OrderBook{
-		Bids: tree.NewWith(bidComparator),
-		Asks: tree.NewWith(askComparator),
+		Bids: feed.NewBids(),
+		Asks: feed.NewAsks(),
 	}
 }
 
 func (ob *OrderBook) Snapshot() *dtos.Snapshot {
+	return ob.TopN(0)
+}
+
+// TopN returns a snapshot of the best depth levels on each side. A depth of 0 returns the full book.
+func (ob *OrderBook) TopN(depth int) *dtos.Snapshot {
 	ob.mu.RLock()
 	defer ob.mu.RUnlock()
 
-	bids := make([][]string, 0, ob.Bids.Size())
-	bidsIt := ob.Bids.Iterator()
-
-	for bidsIt.Next() {
-		bids = append(bids, []string{bidsIt.Key().(string), bidsIt.Value().(string)})
+	return &dtos.Snapshot{
+		LastUpdateId: ob.lastUpdateId,
+		Bids:         feed.TopLevels(ob.Bids, depth, priceLevel),
+		Asks:         feed.TopLevels(ob.Asks, depth, priceLevel),
 	}
+}
+
+// BBO returns the best bid and the best ask of the order book with its last update id.
+func (ob *OrderBook) BBO() (dtos.BBO, int) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
 
-	asks := make([][]string, 0, ob.Asks.Size())
-	asksIt := ob.Asks.Iterator()
+	var bbo dtos.BBO
 
-	for asksIt.Next() {
-		asks = append(asks, []string{asksIt.Key().(string), asksIt.Value().(string)})
+	if bid := ob.Bids.Left(); bid != nil {
+		bbo.BidPrice, bbo.BidQty = formatFloat(bid.Key.(float64)), formatFloat(bid.Value.(float64))
 	}
 
-	return &dtos.Snapshot{
-		LastUpdateId: ob.lastUpdateId,
-		Bids:         bids,
-		Asks:         asks,
+	if ask := ob.Asks.Left(); ask != nil {
+		bbo.AskPrice, bbo.AskQty = formatFloat(ask.Key.(float64)), formatFloat(ask.Value.(float64))
 	}
+
+	return bbo, ob.lastUpdateId
+}
+
+// Levels returns the number of price levels of each side.
+func (ob *OrderBook) Levels() (bids, asks int) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.Bids.Size(), ob.Asks.Size()
 }
 
 func (ob *OrderBook) SetLastUpdateId(lastUpdateId int) {
@@ -64,13 +83,8 @@ func (ob *OrderBook) batchUpdate(bids, asks map[float64]float64, lastUpdateId in
 	ob.mu.Lock()
 	defer ob.mu.Unlock()
 
-	for price, qty := range bids {
-		ob.Bids.Put(price, qty)
-	}
-
-	for price, qty := range asks {
-		ob.Asks.Put(price, qty)
-	}
+	putLevels(ob.Bids, bids)
+	putLevels(ob.Asks, asks)
 
 	ob.lastUpdateId = lastUpdateId
 }
@@ -79,48 +93,28 @@ func (ob *OrderBook) updateBids(bids map[float64]float64) {
 	ob.mu.Lock()
 	defer ob.mu.Unlock()
 
-	for price, qty := range bids {
-		ob.Bids.Put(price, qty)
-	}
+	putLevels(ob.Bids, bids)
 }
 
 func (ob *OrderBook) updateAsks(asks map[float64]float64) {
 	ob.mu.Lock()
 	defer ob.mu.Unlock()
 
-	for price, qty := range asks {
-		ob.Asks.Put(price, qty)
-	}
+	putLevels(ob.Asks, asks)
 }
 
-// askComparator to sort asks.
-func askComparator(a, b interface{}) int {
-	aFloat := a.(float64)
-	bFloat := b.(float64)
-
-	if aFloat < bFloat {
-		return -1
+// putLevels updates the price levels of a side. A zero quantity removes the level.
+func putLevels(side *tree.Tree, levels map[float64]float64) {
+	for price, qty := range levels {
+		feed.PutLevel(side, price, qty)
 	}
-
-	if aFloat > bFloat {
-		return 1
-	}
-
-	return 0
 }
 
-// bidComparator comparator to sort bids.
-func bidComparator(a, b interface{}) int {
-	aFloat := a.(float64)
-	bFloat := b.(float64)
-
-	if aFloat < bFloat {
-		return 1
-	}
-
-	if aFloat > bFloat {
-		return -1
-	}
+// priceLevel formats a tree entry to the [price, qty] string pair used by Binance.
+func priceLevel(price, qty float64) []string {
+	return []string{formatFloat(price), formatFloat(qty)}
+}
 
-	return 0
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
 }
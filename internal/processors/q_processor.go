@@ -3,9 +3,16 @@ package processors
 import (
 	"log/slog"
 	"ob-manager/internal/dtos"
+	"ob-manager/internal/metrics"
 	inqueues "ob-manager/internal/queues/in"
 	outqueues "ob-manager/internal/queues/out"
 	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	bidSide, askSide = "bid", "ask"
 )
 
 type Processor struct {
@@ -14,18 +21,36 @@ type Processor struct {
 
 	currency string
 	isReady  chan bool
+	ready    atomic.Bool
 	ob       *OrderBook
 	quit     chan struct{}
+
+	bbo       dtos.BBO
+	bboSeq    int
+	analytics atomic.Pointer[dtos.Message]
+	// analyticsSettings configure the metrics. The pending ones are published at the next tick of the interval.
+	analyticsSettings AnalyticsSettings
+	analyticsPending  bool
+	analyticsTs       int64
+
+	created       time.Time
+	lastEventTime atomic.Int64
+	lastReceived  atomic.Int64
+	eventLag      atomic.Int64
+	outOfSequence atomic.Bool
 }
 
-func NewProcessor(currency string, inQ *inqueues.InQManager, outQ *outqueues.Queue) *Processor {
+func NewProcessor(currency string, inQ *inqueues.InQManager, outQ *outqueues.Queue,
+	analytics AnalyticsSettings) *Processor {
 	return &Processor{
-		currency: currency,
-		inQ:      inQ,
-		outQ:     outQ,
-		isReady:  make(chan bool),
-		quit:     make(chan struct{}),
-		ob:       NewOrderBook(),
+		currency:          currency,
+		inQ:               inQ,
+		outQ:              outQ,
+		isReady:           make(chan bool),
+		quit:              make(chan struct{}),
+		ob:                NewOrderBook(),
+		created:           time.Now(),
+		analyticsSettings: analytics,
 	}
 }
 
@@ -33,13 +58,56 @@ func (p *Processor) OrderBook() *OrderBook {
 	return p.ob
 }
 
+// Currency returns the currency pair of the order book.
+func (p *Processor) Currency() string {
+	return p.currency
+}
+
+// UpdateBids updates the bids from the snapshot.
+func (p *Processor) UpdateBids(bids map[float64]float64) {
+	p.ob.updateBids(bids)
+}
+
+// UpdateAsks updates the asks from the snapshot.
+func (p *Processor) UpdateAsks(asks map[float64]float64) {
+	p.ob.updateAsks(asks)
+}
+
+// SetReady marks the order book is populated and ready to process push events. It returns right away once the
+// processor is stopped.
 func (p *Processor) SetReady(lastUpdateId int) {
 	p.ob.SetLastUpdateId(lastUpdateId)
-	p.isReady <- true
+	p.ready.Store(true)
+
+	select {
+	case p.isReady <- true:
+	case <-p.quit:
+	}
+}
+
+// IsReady reports whether the order book is populated from the snapshot.
+func (p *Processor) IsReady() bool {
+	return p.ready.Load()
 }
 
 func (p *Processor) startProcessor() {
-	<-p.isReady
+	select {
+	case <-p.isReady:
+	case <-p.quit:
+		slog.Info("Processor Quitting before ready.", "Currency", p.currency)
+
+		return
+	}
+
+	// the analytics walk the book, so they are computed at most once per interval
+	var analyticsTick <-chan time.Time
+
+	if p.analyticsSettings.Interval > 0 {
+		ticker := time.NewTicker(p.analyticsSettings.Interval)
+		defer ticker.Stop()
+
+		analyticsTick = ticker.C
+	}
 
 	for {
 		select {
@@ -47,22 +115,63 @@ func (p *Processor) startProcessor() {
 			slog.Info("Processor Quitting.", "Currency", p.currency)
 
 			return
+		case <-analyticsTick:
+			if p.analyticsPending {
+				p.publishAnalytics(p.analyticsTs)
+			}
 		case event := <-p.inQ.Queue(p.currency):
+			// the conflated events take the room left in the queue
+			p.inQ.Received(p.currency)
+
+			if p.stopped() {
+				return
+			}
+
 			// discard unnecessary bids/asks
 			if event.FinalUpdateId < p.ob.LastUpdateId() {
 				// discard
 				slog.Info("Discarding event.", "curr", p.currency, "Final Id", event.FinalUpdateId, "Last Id", p.ob.LastUpdateId())
+				metrics.DiscardedEvents.WithLabelValues(p.currency).Inc()
 
 				continue
 			}
 
 			slog.Debug("Processing event.", "curr", p.currency, "Final Id", event.FinalUpdateId, "Last Id", p.ob.LastUpdateId())
 
+			// the first event after the snapshot may start before it, the next ones must follow the last one
+			if event.FirstUpdateId > p.ob.LastUpdateId()+1 {
+				slog.Error("Missed events from upstream.", "curr", p.currency, "First Id", event.FirstUpdateId,
+					"Last Id", p.ob.LastUpdateId())
+				p.outOfSequence.Store(true)
+			}
+
+			prevSeq := p.ob.LastUpdateId()
+			start := time.Now()
+
 			// process event
 			p.updateOrderBook(event)
 
+			metrics.ApplyLatency.WithLabelValues(p.currency).Observe(time.Since(start).Seconds())
+			p.lastEventTime.Store(int64(event.EventTime))
+			p.lastReceived.Store(start.UnixMilli())
+			p.eventLag.Store(start.UnixMilli() - int64(event.EventTime))
+
 			// push update to users
-			p.outQ.AddToOutQ(event)
+			p.outQ.AddToOutQ(&dtos.Message{
+				Type:    dtos.TypeDelta,
+				Symbol:  p.currency,
+				Seq:     event.FinalUpdateId,
+				PrevSeq: prevSeq,
+				Ts:      int64(event.EventTime),
+				Data:    event,
+			})
+
+			p.publishBBO(int64(event.EventTime))
+
+			p.analyticsPending, p.analyticsTs = true, int64(event.EventTime)
+			if analyticsTick == nil {
+				p.publishAnalytics(p.analyticsTs)
+			}
 		}
 	}
 }
@@ -71,8 +180,91 @@ func (p *Processor) updateOrderBook(event *dtos.EventUpdate) {
 	bids := p.processEventBids(event.Bids)
 	asks := p.processEventAsks(event.Asks)
 
-	p.ob.lastUpdateId = event.FinalUpdateId
 	p.ob.batchUpdate(bids, asks, event.FinalUpdateId)
+
+	bidLevels, askLevels := p.ob.Levels()
+	metrics.BookLevels.WithLabelValues(p.currency, bidSide).Set(float64(bidLevels))
+	metrics.BookLevels.WithLabelValues(p.currency, askSide).Set(float64(askLevels))
+}
+
+// Status returns the sync state of the order book. The book is stale when no event was applied within
+// the StaleAfter threshold or when the last event was received later than the MaxEventLag threshold.
+func (p *Processor) Status(now time.Time, thresholds StaleThresholds) dtos.SymbolStatus {
+	status := dtos.SymbolStatus{
+		Symbol:         p.currency,
+		State:          dtos.BookSyncing,
+		LastUpdateId:   p.ob.LastUpdateId(),
+		LastEventAgeMs: -1,
+	}
+
+	lastEventTime := p.lastEventTime.Load()
+	if lastEventTime > 0 {
+		status.LastEventAgeMs = now.UnixMilli() - lastEventTime
+	}
+
+	sinceReceived := time.Duration(now.UnixMilli()-p.lastReceived.Load()) * time.Millisecond
+	eventLag := time.Duration(p.eventLag.Load()) * time.Millisecond
+
+	switch {
+	case !p.IsReady() || lastEventTime == 0:
+		status.State = dtos.BookSyncing
+	case p.outOfSequence.Load():
+		status.State = dtos.BookOutOfSequence
+	case sinceReceived > thresholds.StaleAfter || eventLag > thresholds.MaxEventLag:
+		status.State = dtos.BookStale
+	default:
+		status.State = dtos.BookLive
+	}
+
+	return status
+}
+
+// publishBBO pushes the best bid and ask to the users when they changed with the last update.
+func (p *Processor) publishBBO(ts int64) {
+	bbo, seq := p.ob.BBO()
+	if bbo == p.bbo {
+		return
+	}
+
+	p.outQ.AddToOutQ(&dtos.Message{
+		Type:    dtos.TypeBBO,
+		Symbol:  p.currency,
+		Seq:     seq,
+		PrevSeq: p.bboSeq,
+		Ts:      ts,
+		Data:    bbo,
+	})
+
+	p.bbo = bbo
+	p.bboSeq = seq
+}
+
+// publishAnalytics computes the order book metrics after the last update and pushes them to the users.
+func (p *Processor) publishAnalytics(ts int64) {
+	analytics, seq := p.ob.Analytics(p.analyticsSettings.ImbalanceDepth, p.analyticsSettings.DepthBands)
+	p.analyticsPending = false
+
+	var prevSeq int
+	if prev := p.analytics.Load(); prev != nil {
+		prevSeq = prev.Seq
+	}
+
+	message := &dtos.Message{
+		Type:    dtos.TypeAnalytics,
+		Symbol:  p.currency,
+		Seq:     seq,
+		PrevSeq: prevSeq,
+		Ts:      ts,
+		Data:    analytics,
+	}
+
+	p.analytics.Store(message)
+	p.outQ.AddToOutQ(message)
+}
+
+// Analytics returns the latest analytics message of the order book. It is nil until the first update.
+func (p *Processor) Analytics() *dtos.Message {
+	return p.analytics.Load()
 }
 
 // process bids and populate the order book.
@@ -120,3 +312,13 @@ func (p *Processor) processEventAsks(asks [][]string) map[float64]float64 {
 func (p *Processor) stopProcessor() {
 	close(p.quit)
 }
+
+// stopped reports whether the processor is stopped, so that an event read concurrently with the stop is not applied.
+func (p *Processor) stopped() bool {
+	select {
+	case <-p.quit:
+		return true
+	default:
+		return false
+	}
+}
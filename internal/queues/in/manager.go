@@ -1,35 +1,152 @@
 package inqueues
 
 import (
+	"log/slog"
 	"ob-manager/internal/dtos"
+	"ob-manager/internal/metrics"
+	"ob-manager/internal/queues"
 	"sync"
 )
 
 const (
-	queueSize = 10000
+	overflowQueueSize = 100
 )
 
 type InQManager struct {
+	settings  queues.Settings
+	overflows chan string
+
 	mu     sync.RWMutex
-	queues map[string]chan *dtos.EventUpdate
+	queues map[string]*queue
+}
+
+// queue holds the events of a currency pair. With the conflate policy, the events that do not fit in the channel
+// are merged in pending until the processor takes an event off the channel. pending is guarded by mu, which the
+// producer and the processor both take, so that the events stay in order.
+type queue struct {
+	events chan *dtos.EventUpdate
+
+	mu      sync.Mutex
+	pending *dtos.EventUpdate
 }
 
-func NewQManager() *InQManager {
+func NewQManager(settings queues.Settings) *InQManager {
 	return &InQManager{
-		queues: make(map[string]chan *dtos.EventUpdate),
+		settings:  settings,
+		overflows: make(chan string, overflowQueueSize),
+		queues:    make(map[string]*queue),
 	}
 }
 
+// AddToQueue adds the event to the queue of its currency pair, applying the overflow policy when the queue is full.
 func (m *InQManager) AddToQueue(eventUpdate *dtos.EventUpdate) {
 	q := m.getOrCreateQueue(eventUpdate.Symbol)
-	q <- eventUpdate
+
+	if m.settings.Policy == queues.Conflate {
+		m.addOrConflate(q, eventUpdate)
+
+		return
+	}
+
+	select {
+	case q.events <- eventUpdate:
+		return
+	default:
+	}
+
+	m.overflow(eventUpdate)
+
+	if m.settings.Policy == queues.DropWithResync {
+		slog.Error("In Queue full, dropping event.", "Currency", eventUpdate.Symbol, "Final Id", eventUpdate.FinalUpdateId)
+		m.notifyOverflow(eventUpdate.Symbol)
+
+		return
+	}
+
+	q.events <- eventUpdate
+}
+
+// addOrConflate merges the event with the pending events of its currency pair when the queue is full.
+// Once a currency pair has pending events, its next events are merged too to keep them in order.
+func (m *InQManager) addOrConflate(q *queue, eventUpdate *dtos.EventUpdate) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.pending != nil {
+		m.overflow(eventUpdate)
+		q.pending = q.pending.Merge(eventUpdate)
+
+		return
+	}
+
+	select {
+	case q.events <- eventUpdate:
+	default:
+		m.overflow(eventUpdate)
+		q.pending = eventUpdate
+	}
+}
+
+// Received is called by the processor of a currency pair after taking an event off its queue. With the conflate
+// policy, it moves the pending events to the room left in the queue.
+func (m *InQManager) Received(symbol string) {
+	if m.settings.Policy != queues.Conflate {
+		return
+	}
+
+	q := m.getOrCreateQueue(symbol)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.pending == nil {
+		return
+	}
+
+	// the producer does not add to the queue while events are pending, so the room is still there
+	select {
+	case q.events <- q.pending:
+		q.pending = nil
+	default:
+	}
+}
+
+func (m *InQManager) overflow(eventUpdate *dtos.EventUpdate) {
+	metrics.QueueOverflows.WithLabelValues(metrics.InQueue, eventUpdate.Symbol, string(m.settings.Policy)).Inc()
+}
+
+// notifyOverflow reports the currency pair whose events were dropped so that its order book is resynced.
+func (m *InQManager) notifyOverflow(symbol string) {
+	select {
+	case m.overflows <- symbol:
+	default:
+	}
+}
+
+// Overflows returns the currency pairs whose events were dropped.
+func (m *InQManager) Overflows() <-chan string {
+	return m.overflows
 }
 
 func (m *InQManager) Queue(symbol string) <-chan *dtos.EventUpdate {
-	return m.getOrCreateQueue(symbol)
+	return m.getOrCreateQueue(symbol).events
+}
+
+// Lengths returns the number of events waiting in each queue.
+func (m *InQManager) Lengths() map[string]int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	lengths := make(map[string]int, len(m.queues))
+
+	for symbol, q := range m.queues {
+		lengths[symbol] = len(q.events)
+	}
+
+	return lengths
 }
 
-func (m *InQManager) getOrCreateQueue(currency string) chan *dtos.EventUpdate {
+func (m *InQManager) getOrCreateQueue(currency string) *queue {
 	m.mu.RLock() // read lock
 
 	if q, ok := m.queues[currency]; ok {
@@ -48,7 +165,7 @@ func (m *InQManager) getOrCreateQueue(currency string) chan *dtos.EventUpdate {
 		return q
 	}
 
-	q := make(chan *dtos.EventUpdate, queueSize)
+	q := &queue{events: make(chan *dtos.EventUpdate, m.settings.Size)}
 	m.queues[currency] = q
 
 	return q
@@ -1,23 +1,287 @@
 package outqueues
 
-import "ob-manager/internal/dtos"
+import (
+	"context"
+	"hash/fnv"
+	"log/slog"
+	"ob-manager/internal/dtos"
+	"ob-manager/internal/metrics"
+	"ob-manager/internal/queues"
+	"sync"
+	"time"
+)
 
+const (
+	flushInterval = 10 * time.Millisecond
+)
+
+// Queue is sharded by currency pair. The messages of a currency pair always go to the same shard,
+// so they are consumed in order while the shards are consumed in parallel.
 type Queue struct {
-	q chan *dtos.EventUpdate
+	shards []*shard
+}
+
+func NewQueue(settings queues.Settings, shards int) *Queue {
+	q := &Queue{
+		shards: make([]*shard, shards),
+	}
+
+	for i := range q.shards {
+		q.shards[i] = newShard(settings)
+	}
+
+	return q
+}
+
+// Run moves the conflated messages of the shards to their queue when there is room, until the context is done.
+// The queue only conflates its messages with the conflate policy.
+func (q *Queue) Run(ctx context.Context) error {
+	var flushers sync.WaitGroup
+
+	for _, s := range q.shards {
+		if s.settings.Policy == queues.Conflate {
+			flushers.Go(func() { s.flushPending(ctx) })
+		}
+	}
+
+	<-ctx.Done()
+	flushers.Wait()
+
+	return nil
+}
+
+// AddToOutQ adds the message to the shard of its currency pair.
+func (q *Queue) AddToOutQ(message *dtos.Message) {
+	q.shard(message.Symbol).AddToOutQ(message)
+}
+
+// OutQs returns the channels of the shards.
+func (q *Queue) OutQs() []<-chan *dtos.Message {
+	outQs := make([]<-chan *dtos.Message, 0, len(q.shards))
+
+	for _, s := range q.shards {
+		outQs = append(outQs, s.q)
+	}
+
+	return outQs
+}
+
+// Length returns the number of messages waiting in the shards.
+func (q *Queue) Length() int {
+	var length int
+
+	for _, s := range q.shards {
+		length += len(s.q)
+	}
+
+	return length
+}
+
+func (q *Queue) shard(symbol string) *shard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(symbol))
+
+	return q.shards[h.Sum32()%uint32(len(q.shards))]
+}
+
+type shard struct {
+	settings queues.Settings
+	q        chan *dtos.Message
+
+	mu      sync.Mutex
+	resyncs map[string]struct{}
+	pending map[string]*conflated
+}
+
+func newShard(settings queues.Settings) *shard {
+	q := &shard{
+		settings: settings,
+		q:        make(chan *dtos.Message, settings.Size),
+		resyncs:  make(map[string]struct{}),
+		pending:  make(map[string]*conflated),
+	}
+
+	return q
+}
+
+// AddToOutQ adds the message to the shard, applying the overflow policy when the queue is full.
+func (q *shard) AddToOutQ(message *dtos.Message) {
+	switch q.settings.Policy {
+	case queues.DropWithResync:
+		q.addOrDrop(message)
+	case queues.Conflate:
+		q.addOrConflate(message)
+	default:
+		if !q.tryAdd(message) {
+			q.overflow(message)
+			q.q <- message
+		}
+	}
+}
+
+func (q *shard) tryAdd(message *dtos.Message) bool {
+	select {
+	case q.q <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+func (q *shard) overflow(message *dtos.Message) {
+	metrics.QueueOverflows.WithLabelValues(metrics.OutQueue, message.Symbol, string(q.settings.Policy)).Inc()
 }
 
-func NewQueue() *Queue {
-	queueSize := 40000
+// addOrDrop drops the message when the queue is full. The subscribers of the currency pair
+// get a resync message before its next message, so that they receive a new snapshot.
+func (q *shard) addOrDrop(message *dtos.Message) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
 
-	return &Queue{
-		q: make(chan *dtos.EventUpdate, queueSize),
+	if _, ok := q.resyncs[message.Symbol]; ok && message.Type != dtos.TypeResync {
+		resync := &dtos.Message{
+			Type:   dtos.TypeResync,
+			Symbol: message.Symbol,
+			Ts:     time.Now().UnixMilli(),
+			Data:   dtos.ResyncNotice{Reason: "out-queue overflow"},
+		}
+
+		if !q.tryAdd(resync) {
+			q.overflow(message)
+
+			return
+		}
+	}
+
+	delete(q.resyncs, message.Symbol)
+
+	if !q.tryAdd(message) {
+		slog.Error("Out Queue full, dropping message.", "Currency", message.Symbol, "Type", message.Type)
+		q.overflow(message)
+		q.resyncs[message.Symbol] = struct{}{}
+	}
+}
+
+// addOrConflate merges the message with the pending messages of its currency pair when the queue is full.
+// Once a currency pair has pending messages, its next messages are merged too to keep them in order.
+func (q *shard) addOrConflate(message *dtos.Message) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if p, ok := q.pending[message.Symbol]; ok {
+		p.add(message)
+
+		return
+	}
+
+	if !q.tryAdd(message) {
+		q.overflow(message)
+
+		p := newConflated()
+		p.add(message)
+		q.pending[message.Symbol] = p
 	}
 }
 
-func (q *Queue) AddToOutQ(event *dtos.EventUpdate) {
-	q.q <- event
+// flushPending moves the conflated messages to the queue when there is room.
+func (q *shard) flushPending(ctx context.Context) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		q.mu.Lock()
+
+		for symbol, p := range q.pending {
+			if p.flush(q.tryAdd) {
+				delete(q.pending, symbol)
+			}
+		}
+
+		q.mu.Unlock()
+	}
+}
+
+// conflated keeps the messages of a currency pair waiting for room in the queue.
+// Deltas are merged in one delta and only the latest message of the other types is kept.
+type conflated struct {
+	delta  *dtos.Message
+	latest map[dtos.MessageType]*dtos.Message
+	order  []dtos.MessageType
 }
 
-func (q *Queue) OutQ() <-chan *dtos.EventUpdate {
-	return q.q
+func newConflated() *conflated {
+	return &conflated{
+		latest: make(map[dtos.MessageType]*dtos.Message),
+	}
+}
+
+func (c *conflated) add(message *dtos.Message) {
+	switch message.Type {
+	case dtos.TypeDelta:
+		if c.delta == nil {
+			c.delta = message
+
+			return
+		}
+
+		merged := *message
+		merged.PrevSeq = c.delta.PrevSeq
+		merged.Data = c.delta.Data.(*dtos.EventUpdate).Merge(message.Data.(*dtos.EventUpdate))
+		c.delta = &merged
+	case dtos.TypeResync:
+		// the subscribers will get a new snapshot, so the pending deltas are obsolete
+		c.delta = nil
+		c.keep(message)
+	default:
+		c.keep(message)
+	}
+}
+
+func (c *conflated) keep(message *dtos.Message) {
+	if _, ok := c.latest[message.Type]; !ok {
+		c.order = append(c.order, message.Type)
+	}
+
+	c.latest[message.Type] = message
+}
+
+// flush adds the pending messages to the queue, the resync and the delta first. It returns true when all were added.
+func (c *conflated) flush(add func(*dtos.Message) bool) bool {
+	if resync, ok := c.latest[dtos.TypeResync]; ok {
+		if !add(resync) {
+			return false
+		}
+
+		delete(c.latest, dtos.TypeResync)
+	}
+
+	if c.delta != nil {
+		if !add(c.delta) {
+			return false
+		}
+
+		c.delta = nil
+	}
+
+	for len(c.order) > 0 {
+		msgType := c.order[0]
+
+		if message, ok := c.latest[msgType]; ok {
+			if !add(message) {
+				return false
+			}
+
+			delete(c.latest, msgType)
+		}
+
+		c.order = c.order[1:]
+	}
+
+	return true
 }
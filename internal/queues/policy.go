@@ -0,0 +1,32 @@
+// Package queues holds the settings shared by the in-queues and the out-queue.
+package queues
+
+import "fmt"
+
+// OverflowPolicy decides what happens to a message added to a full queue.
+type OverflowPolicy string
+
+const (
+	// Block waits for room in the queue, stalling the producer.
+	Block OverflowPolicy = "block"
+	// DropWithResync drops the message and resyncs the order book of its currency pair.
+	DropWithResync OverflowPolicy = "drop-with-resync"
+	// Conflate merges the messages of a currency pair until there is room in the queue.
+	Conflate OverflowPolicy = "conflate"
+)
+
+// ParsePolicy validates an overflow policy name.
+func ParsePolicy(name string) (OverflowPolicy, error) {
+	switch policy := OverflowPolicy(name); policy {
+	case Block, DropWithResync, Conflate:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown overflow policy %s", name)
+	}
+}
+
+// Settings of a queue.
+type Settings struct {
+	Size   int
+	Policy OverflowPolicy
+}
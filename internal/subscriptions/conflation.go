@@ -0,0 +1,93 @@
+package subscriptions
+
+import (
+	"time"
+
+	"ob-manager/internal/dtos"
+)
+
+// pendingDelta coalesces the deltas of a conflated subscription until the next publish.
+// Only the latest quantity of each price level is kept, so the final state of the book is preserved.
+type pendingDelta struct {
+	bids      map[string]string
+	asks      map[string]string
+	seq       int
+	ts        int64
+	nextFlush time.Time
+}
+
+func newPendingDelta(interval time.Duration) *pendingDelta {
+	return &pendingDelta{
+		bids:      make(map[string]string),
+		asks:      make(map[string]string),
+		nextFlush: time.Now().Add(interval),
+	}
+}
+
+// merge adds the levels of a delta to the pending delta.
+func (p *pendingDelta) merge(seq int, ts int64, event *dtos.EventUpdate) {
+	for _, level := range event.Bids {
+		p.bids[level[0]] = level[1]
+	}
+
+	for _, level := range event.Asks {
+		p.asks[level[0]] = level[1]
+	}
+
+	p.seq = seq
+	p.ts = ts
+}
+
+// due reports whether the publish interval has elapsed and schedules the next publish.
+func (p *pendingDelta) due(now time.Time, interval time.Duration) bool {
+	if now.Before(p.nextFlush) {
+		return false
+	}
+
+	p.nextFlush = p.nextFlush.Add(interval)
+	if p.nextFlush.Before(now) {
+		p.nextFlush = now.Add(interval)
+	}
+
+	return true
+}
+
+// flush returns the coalesced delta following prevSeq and clears the pending levels.
+// It returns nil if no delta was merged since the last flush.
+func (p *pendingDelta) flush(symbol string, prevSeq int) *dtos.Message {
+	if p.seq <= prevSeq {
+		return nil
+	}
+
+	event := &dtos.EventUpdate{
+		EventType:     depthUpdateEvent,
+		EventTime:     int(p.ts),
+		Symbol:        symbol,
+		FirstUpdateId: prevSeq + 1,
+		FinalUpdateId: p.seq,
+		Bids:          levels(p.bids),
+		Asks:          levels(p.asks),
+	}
+
+	clear(p.bids)
+	clear(p.asks)
+
+	return &dtos.Message{
+		Type:    dtos.TypeDelta,
+		Symbol:  symbol,
+		Seq:     p.seq,
+		PrevSeq: prevSeq,
+		Ts:      p.ts,
+		Data:    event,
+	}
+}
+
+func levels(side map[string]string) [][]string {
+	levels := make([][]string, 0, len(side))
+
+	for price, qty := range side {
+		levels = append(levels, []string{price, qty})
+	}
+
+	return levels
+}
@@ -0,0 +1,87 @@
+package subscriptions
+
+import (
+	"ob-manager/internal/dtos"
+)
+
+// depthView keeps the top-N or grouped window of a currency pair last sent to the depth subscribers.
+type depthView struct {
+	depth int
+	bids  map[string]string
+	asks  map[string]string
+	seq   int
+
+	snapshot *dtos.Snapshot
+}
+
+func newDepthView(depth int) *depthView {
+	return &depthView{
+		depth: depth,
+		bids:  make(map[string]string),
+		asks:  make(map[string]string),
+	}
+}
+
+// update moves the window to the given top-N snapshot and returns the delta of the levels changed.
+// Levels that left the window are returned with a zero quantity. ok is false if the window did not change.
+func (v *depthView) update(snapshot *dtos.Snapshot) (delta *dtos.EventUpdate, ok bool) {
+	if snapshot.LastUpdateId <= v.seq {
+		return nil, false
+	}
+
+	bids := diffLevels(v.bids, snapshot.Bids)
+	asks := diffLevels(v.asks, snapshot.Asks)
+
+	if len(bids) == 0 && len(asks) == 0 {
+		return nil, false
+	}
+
+	delta = &dtos.EventUpdate{
+		EventType:     depthUpdateEvent,
+		FirstUpdateId: v.seq + 1,
+		FinalUpdateId: snapshot.LastUpdateId,
+		Bids:          bids,
+		Asks:          asks,
+	}
+
+	v.seq = snapshot.LastUpdateId
+	v.snapshot = snapshot
+
+	return delta, true
+}
+
+// reset sets the window to the given top-N snapshot without producing a delta.
+func (v *depthView) reset(snapshot *dtos.Snapshot) {
+	clear(v.bids)
+	clear(v.asks)
+	diffLevels(v.bids, snapshot.Bids)
+	diffLevels(v.asks, snapshot.Asks)
+
+	v.seq = snapshot.LastUpdateId
+	v.snapshot = snapshot
+}
+
+// diffLevels replaces the window levels with the given levels and returns the levels changed.
+func diffLevels(window map[string]string, levels [][]string) [][]string {
+	changes := make([][]string, 0)
+	current := make(map[string]struct{}, len(levels))
+
+	for _, level := range levels {
+		price, qty := level[0], level[1]
+		current[price] = struct{}{}
+
+		if window[price] != qty {
+			window[price] = qty
+			changes = append(changes, level)
+		}
+	}
+
+	for price := range window {
+		if _, ok := current[price]; !ok {
+			delete(window, price)
+			changes = append(changes, []string{price, zeroQty})
+		}
+	}
+
+	return changes
+}
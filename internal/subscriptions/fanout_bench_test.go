@@ -0,0 +1,239 @@
+package subscriptions_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ob-manager/internal/dtos"
+	"ob-manager/internal/encoding"
+	"ob-manager/internal/queues"
+	outqueues "ob-manager/internal/queues/out"
+	"ob-manager/internal/subscriptions"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	benchSymbol = "BTCUSDT"
+	bookLevels  = 10
+	sendBuffer  = 1024
+	waitPoll    = 100 * time.Microsecond
+	// bookUpdateId is the last update id of the snapshot, the deltas follow it
+	bookUpdateId = 1
+)
+
+// BenchmarkFanout measures the push of depth deltas to many subscribers over in-memory connections discarding
+// the frames, so that it measures the cost of the fan-out without the network. Each operation is a delta
+// delivered to all the subscribers.
+//
+//	go test ./internal/subscriptions -run '^$' -bench Fanout -timeout 0
+func BenchmarkFanout(b *testing.B) {
+	// the subscriptions are logged one by one
+	logger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(discardWriter{}, nil)))
+	b.Cleanup(func() { slog.SetDefault(logger) })
+
+	for _, enc := range []encoding.Encoding{encoding.JSON, encoding.MsgPack} {
+		for _, compressed := range []bool{false, true} {
+			for _, n := range []int{100, 1000, 10000} {
+				name := fmt.Sprintf("%s/compressed=%t/subscribers=%d", enc, compressed, n)
+				b.Run(name, func(b *testing.B) {
+					benchmarkFanout(b, n, enc, compressed)
+				})
+			}
+		}
+	}
+}
+
+// benchmarkFanout subscribes n users to the full book and pushes b.N deltas to them.
+func benchmarkFanout(b *testing.B, n int, enc encoding.Encoding, compressed bool) {
+	var writes atomic.Int64
+
+	outQ := outqueues.NewQueue(queues.Settings{Size: sendBuffer, Policy: queues.Block}, 1)
+	manager := subscriptions.NewManager(outQ, emptyBook{}, sendBuffer)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() { _ = manager.Run(ctx) }()
+
+	conns := make([]*websocket.Conn, 0, n)
+
+	defer func() {
+		for _, conn := range conns {
+			manager.RemoveUser(conn)
+			_ = conn.Close()
+		}
+	}()
+
+	for range n {
+		conn, err := newConn(&writes, compressed)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		conns = append(conns, conn)
+		manager.AddUser(conn, subscriptions.ConnOptions{Encoding: enc})
+		manager.AddSubscription(benchSymbol, conn, subscriptions.Options{Stream: subscriptions.StreamDepth})
+	}
+
+	// the first delta sends the snapshot to each subscriber
+	writes.Store(0)
+	outQ.AddToOutQ(delta(bookUpdateId + 1))
+	wait(b, &writes, int64(2*n))
+
+	writes.Store(0)
+	b.ResetTimer()
+
+	// the deltas are pushed in batches fitting the buffers, so that no subscriber is closed as a slow consumer
+	for sent := 0; sent < b.N; {
+		batch := min(sendBuffer, b.N-sent)
+
+		for i := range batch {
+			outQ.AddToOutQ(delta(bookUpdateId + 2 + sent + i))
+		}
+
+		sent += batch
+		wait(b, &writes, int64(n*sent))
+	}
+
+	b.StopTimer()
+
+	b.ReportMetric(float64(n*b.N)/b.Elapsed().Seconds(), "deliveries/s")
+}
+
+// wait waits until the connections wrote the given number of frames.
+func wait(b *testing.B, writes *atomic.Int64, frames int64) {
+	deadline := time.Now().Add(time.Minute)
+
+	for writes.Load() < frames {
+		if time.Now().After(deadline) {
+			b.Fatalf("%d of %d frames written", writes.Load(), frames)
+		}
+
+		time.Sleep(waitPoll)
+	}
+}
+
+// delta returns a depth update of bookLevels levels on each side.
+func delta(seq int) *dtos.Message {
+	event := &dtos.EventUpdate{
+		EventType:     "depthUpdate",
+		EventTime:     int(time.Now().UnixMilli()),
+		Symbol:        benchSymbol,
+		FirstUpdateId: seq,
+		FinalUpdateId: seq,
+	}
+
+	for i := range bookLevels {
+		qty := strconv.FormatFloat(float64(seq%100)+0.125, 'f', -1, 64)
+		event.Bids = append(event.Bids, []string{strconv.Itoa(65000 - i), qty})
+		event.Asks = append(event.Asks, []string{strconv.Itoa(65001 + i), qty})
+	}
+
+	return &dtos.Message{
+		Type:    dtos.TypeDelta,
+		Symbol:  benchSymbol,
+		Seq:     seq,
+		PrevSeq: seq - 1,
+		Ts:      int64(event.EventTime),
+		Data:    event,
+	}
+}
+
+// emptyBook serves an empty synced order book to the new subscribers.
+type emptyBook struct{}
+
+func (emptyBook) GetOrderBook(string, int) (*dtos.Snapshot, error) {
+	return &dtos.Snapshot{LastUpdateId: bookUpdateId, Bids: [][]string{}, Asks: [][]string{}}, nil
+}
+
+func (emptyBook) GetGroupedOrderBook(string, float64, int) (*dtos.Snapshot, error) {
+	return &dtos.Snapshot{LastUpdateId: bookUpdateId, Bids: [][]string{}, Asks: [][]string{}}, nil
+}
+
+// newConn upgrades an in-memory connection counting the frames written. A compressed connection negotiates
+// permessage-deflate.
+func newConn(writes *atomic.Int64, compressed bool) (*websocket.Conn, error) {
+	req, err := http.NewRequest(http.MethodGet, "/ws", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+
+	if compressed {
+		req.Header.Set("Sec-WebSocket-Extensions", "permessage-deflate; server_no_context_takeover; "+
+			"client_no_context_takeover")
+	}
+
+	w := &hijackWriter{
+		header: make(http.Header),
+		conn:   &discardConn{writes: writes, closed: make(chan struct{})},
+	}
+
+	return (&websocket.Upgrader{EnableCompression: compressed}).Upgrade(w, req, nil)
+}
+
+// hijackWriter hands the in-memory connection to the websocket upgrader.
+type hijackWriter struct {
+	header http.Header
+	conn   net.Conn
+}
+
+func (w *hijackWriter) Header() http.Header         { return w.header }
+func (w *hijackWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *hijackWriter) WriteHeader(int)             {}
+
+func (w *hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.conn, bufio.NewReadWriter(bufio.NewReader(w.conn), bufio.NewWriter(w.conn)), nil
+}
+
+// discardConn counts and discards the writes. Reads block until it is closed.
+type discardConn struct {
+	writes *atomic.Int64
+	closed chan struct{}
+	once   atomic.Bool
+}
+
+func (c *discardConn) Read([]byte) (int, error) {
+	<-c.closed
+
+	return 0, net.ErrClosed
+}
+
+func (c *discardConn) Write(b []byte) (int, error) {
+	c.writes.Add(1)
+
+	return len(b), nil
+}
+
+func (c *discardConn) Close() error {
+	if c.once.CompareAndSwap(false, true) {
+		close(c.closed)
+	}
+
+	return nil
+}
+
+func (c *discardConn) LocalAddr() net.Addr              { return &net.TCPAddr{} }
+func (c *discardConn) RemoteAddr() net.Addr             { return &net.TCPAddr{} }
+func (c *discardConn) SetDeadline(time.Time) error      { return nil }
+func (c *discardConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *discardConn) SetWriteDeadline(time.Time) error { return nil }
+
+// discardWriter drops the logs of the benchmark.
+type discardWriter struct{}
+
+func (discardWriter) Write(b []byte) (int, error) { return len(b), nil }
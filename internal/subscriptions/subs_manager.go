@@ -1,31 +1,114 @@
 package subscriptions
 
 import (
-	"encoding/json"
+	"context"
 	"log/slog"
+	"maps"
 	"slices"
+	"sync"
+	"time"
 
 	"ob-manager/internal/dtos"
+	"ob-manager/internal/encoding"
+	"ob-manager/internal/metrics"
 
 	"github.com/gorilla/websocket"
 )
 
+const (
+	heartbeatInterval = 30 * time.Second
+	conflationTick    = 25 * time.Millisecond
+	depthUpdateEvent  = "depthUpdate"
+	zeroQty           = "0"
+)
+
+// OutQGetter returns the out-queue shards. The messages of a currency pair are all in the same shard.
 type OutQGetter interface {
-	OutQ() <-chan *dtos.EventUpdate
+	OutQs() []<-chan *dtos.Message
 }
 
 type OBGetter interface {
-	GetOrderBook(curr string) ([]byte, int)
+	GetOrderBook(curr string, depth int) (*dtos.Snapshot, error)
+	GetGroupedOrderBook(curr string, step float64, depth int) (*dtos.Snapshot, error)
 }
 
-type User struct {
-	conn         *websocket.Conn
+// Stream of a currency pair a user can subscribe to.
+type Stream string
+
+const (
+	StreamDepth     Stream = "depth"
+	StreamBBO       Stream = "bbo"
+	StreamAnalytics Stream = "analytics"
+)
+
+// stateStreams are the streams whose messages carry the full state, so only the latest message matters.
+var stateStreams = map[dtos.MessageType]Stream{
+	dtos.TypeBBO:       StreamBBO,
+	dtos.TypeAnalytics: StreamAnalytics,
+}
+
+// Options of a subscription.
+type Options struct {
+	Stream Stream
+	// Depth limits the order book to the best levels on each side. 0 subscribes to the full book.
+	Depth int
+	// Group aggregates the order book to price buckets of the given step. 0 keeps the raw price levels.
+	Group float64
+	// Interval conflates the updates and publishes them at most once per interval. 0 publishes every update.
+	Interval time.Duration
+}
+
+// Subscription of a user to a currency pair.
+type Subscription struct {
+	user         *User
+	options      Options
 	lastUpdateId int
+	pending      *pendingDelta
+	latest       *dtos.Message
+}
+
+func newSubscription(user *User, options Options) *Subscription {
+	s := &Subscription{
+		user:    user,
+		options: options,
+	}
+
+	if options.Interval > 0 {
+		s.pending = newPendingDelta(options.Interval)
+	}
+
+	return s
+}
+
+type viewKey struct {
+	currency string
+	depth    int
+	group    float64
+}
+
+// viewKey returns the key of the window of the subscription. ok is false if the subscription
+// is not to a top-N or grouped view of the order book.
+func (s *Subscription) viewKey(currency string) (key viewKey, ok bool) {
+	if s.options.Stream != StreamDepth || (s.options.Depth == 0 && s.options.Group == 0) {
+		return key, false
+	}
+
+	return viewKey{currency: currency, depth: s.options.Depth, group: s.options.Group}, true
+}
+
+// symbolSubs are the subscriptions of a currency pair with the windows and the latest state sent to them.
+// Each currency pair has its own lock, so that the currency pairs are pushed in parallel.
+type symbolSubs struct {
+	mu    sync.Mutex
+	subs  []*Subscription
+	views map[viewKey]*depthView
+	state map[Stream]*dtos.Message
 }
 
-func NewUser(conn *websocket.Conn) *User {
-	return &User{
-		conn: conn,
+func newSymbolSubs() *symbolSubs {
+	return &symbolSubs{
+		views: make(map[viewKey]*depthView),
+		state: make(map[Stream]*dtos.Message),
 	}
 }
 
@@ -33,98 +116,553 @@ type Manager struct {
 	OutQGetter
 	OBGetter
 
-	subs map[string][]*User
+	sendBuffer int
+
+	mu      sync.RWMutex
+	users   map[*websocket.Conn]*User
+	symbols map[string]*symbolSubs
 }
 
-func NewManager(getter OutQGetter, obGetter OBGetter) *Manager {
-	m := Manager{
+// NewManager creates the subscriptions store. The messages are pushed to the users by Run.
+// sendBuffer is the number of messages buffered for each user.
+func NewManager(getter OutQGetter, obGetter OBGetter, sendBuffer int) *Manager {
+	m := &Manager{
 		OutQGetter: getter,
 		OBGetter:   obGetter,
-		subs:       make(map[string][]*User),
+		sendBuffer: sendBuffer,
+		users:      make(map[*websocket.Conn]*User),
+		symbols:    make(map[string]*symbolSubs),
 	}
 
-	// start the push handler for the subscribed users
-	m.startPushHandler()
-
-	return &m
+	return m
 }
 
-// AddSubscription adds a subscription for the user to a currency pair.
-func (m *Manager) AddSubscription(currency string, conn *websocket.Conn) {
-	if m.subs[currency] == nil {
-		m.subs[currency] = make([]*User, 0)
+// Drain closes the connections of all the users for a shutdown. The messages buffered for each user are written
+// until the deadline of the context, then the connection is closed with a going away message. It returns the
+// number of users and the messages dropped: the messages left in the buffers and the messages sent meanwhile.
+func (m *Manager) Drain(ctx context.Context) (users, dropped int) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(writeTimeout)
 	}
 
-	user := NewUser(conn)
+	m.mu.RLock()
+	all := slices.Collect(maps.Values(m.users))
+	m.mu.RUnlock()
 
-	m.subs[currency] = append(m.subs[currency], user)
+	for _, u := range all {
+		u.drain(deadline)
+	}
+
+	for _, u := range all {
+		select {
+		case <-u.finished:
+		case <-ctx.Done():
+			// the writer is stuck on the network, the reader of the connection removes the user
+			if err := u.conn.Close(); err != nil {
+				slog.Error("Error on Closing the Connection", "Error", err)
+			}
+		}
 
-	slog.Info("User Subscribed", "Currency", currency)
+		dropped += int(u.dropped.Load()) + len(u.send)
+	}
+
+	return len(all), dropped
 }
 
-// RemoveSubscription removes a subscription for the user to a currency pair.
-func (m *Manager) RemoveSubscription(currency string, conn *websocket.Conn) {
-	index := -1
+// AddSubscription adds a subscription for the user to a stream of a currency pair.
+// An existing subscription of the user to the same stream is replaced.
+func (m *Manager) AddSubscription(currency string, conn *websocket.Conn, options Options) {
+	m.mu.Lock()
+	user := m.getOrCreateUser(conn)
+	ss := m.getOrCreateSymbol(currency)
+	m.mu.Unlock()
 
-	for i, u := range m.subs[currency] {
-		if u.conn == conn {
-			index = i
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
 
-			break
-		}
+	ss.removeSubscription(currency, conn, options.Stream)
+
+	sub := newSubscription(user, options)
+
+	ss.subs = append(ss.subs, sub)
+	metrics.Subscribers.WithLabelValues(currency).Set(float64(len(ss.subs)))
+
+	// state streams only change with the book, so send the latest state right away
+	if latest, ok := ss.state[options.Stream]; ok {
+		sub.lastUpdateId = latest.Seq
+		m.sendMessage(user, latest)
 	}
 
-	if index != -1 {
-		m.subs[currency] = slices.Delete(m.subs[currency], index, index+1)
+	slog.Info("User Subscribed", "Currency", currency, "Stream", options.Stream,
+		"Depth", options.Depth, "Group", options.Group, "Interval", options.Interval)
+}
 
-		slog.Info("Subscription Removed", "Currency", currency)
+// RemoveSubscription removes a subscription for the user to a stream of a currency pair.
+// An empty stream removes all the subscriptions of the user to the currency pair.
+func (m *Manager) RemoveSubscription(currency string, conn *websocket.Conn, stream Stream) {
+	ss := m.symbol(currency)
+	if ss == nil {
+		return
 	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	ss.removeSubscription(currency, conn, stream)
 }
 
-// RemoveUser removes all the subscriptions from a user.
+// RemoveUser removes all the subscriptions from a user and stops its writer.
 func (m *Manager) RemoveUser(conn *websocket.Conn) {
-	for curr := range m.subs {
-		m.RemoveSubscription(curr, conn)
+	m.mu.Lock()
+	user, ok := m.users[conn]
+	delete(m.users, conn)
+	symbols := make(map[string]*symbolSubs, len(m.symbols))
+	maps.Copy(symbols, m.symbols)
+	m.mu.Unlock()
+
+	for curr, ss := range symbols {
+		ss.mu.Lock()
+		ss.removeSubscription(curr, conn, "")
+		ss.mu.Unlock()
+	}
+
+	if ok {
+		user.close()
+	}
+}
+
+// SubscriberCount returns the number of subscriptions to a currency pair.
+func (m *Manager) SubscriberCount(currency string) int {
+	ss := m.symbol(currency)
+	if ss == nil {
+		return 0
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	return len(ss.subs)
+}
+
+// AddUser registers a connected user with the options negotiated for its messages.
+// The users sending commands without being added get uncompressed JSON messages.
+func (m *Manager) AddUser(conn *websocket.Conn, options ConnOptions) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[conn]; !ok {
+		m.users[conn] = NewUser(conn, options, m.sendBuffer)
+	}
+}
+
+// SendMessage sends a message to a connected user.
+func (m *Manager) SendMessage(conn *websocket.Conn, message *dtos.Message) {
+	m.mu.Lock()
+	user := m.getOrCreateUser(conn)
+	m.mu.Unlock()
+
+	m.sendMessage(user, message)
+}
+
+func (m *Manager) getOrCreateUser(conn *websocket.Conn) *User {
+	user, ok := m.users[conn]
+	if !ok {
+		user = NewUser(conn, ConnOptions{Encoding: encoding.JSON}, m.sendBuffer)
+		m.users[conn] = user
+	}
+
+	return user
+}
+
+func (m *Manager) getOrCreateSymbol(currency string) *symbolSubs {
+	ss, ok := m.symbols[currency]
+	if !ok {
+		ss = newSymbolSubs()
+		m.symbols[currency] = ss
+	}
+
+	return ss
+}
+
+// symbol returns the subscriptions of a currency pair. It is nil if the currency pair was never subscribed.
+func (m *Manager) symbol(currency string) *symbolSubs {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.symbols[currency]
+}
+
+func (ss *symbolSubs) removeSubscription(currency string, conn *websocket.Conn, stream Stream) {
+	var removed []*Subscription
+
+	ss.subs = slices.DeleteFunc(ss.subs, func(s *Subscription) bool {
+		if s.user.conn != conn || (stream != "" && s.options.Stream != stream) {
+			return false
+		}
+
+		removed = append(removed, s)
+
+		return true
+	})
+
+	for _, s := range removed {
+		if key, ok := s.viewKey(currency); ok {
+			ss.removeUnusedView(key)
+		}
+
+		slog.Info("Subscription Removed", "Currency", currency, "Stream", s.options.Stream)
+	}
+
+	switch {
+	case len(removed) == 0:
+	case len(ss.subs) == 0:
+		// drop the series of the currency pairs nobody subscribes to anymore
+		metrics.Subscribers.DeleteLabelValues(currency)
+	default:
+		metrics.Subscribers.WithLabelValues(currency).Set(float64(len(ss.subs)))
+	}
+}
+
+// removeUnusedView drops a window of a currency pair when no subscription uses it.
+func (ss *symbolSubs) removeUnusedView(key viewKey) {
+	inUse := slices.ContainsFunc(ss.subs, func(s *Subscription) bool {
+		subKey, ok := s.viewKey(key.currency)
+
+		return ok && subKey == key
+	})
+
+	if !inUse {
+		delete(ss.views, key)
 	}
 }
 
-// StartPushHandler creates a go routine that handles push messages to the subscribers.
-func (m *Manager) startPushHandler() {
-	go func() {
-		slog.Info("Starting Push Handler")
+// Run pushes the messages of the out-queue to the subscribed users until the context is done. The messages left
+// in the out-queue are not pushed. There is a push worker per out-queue shard, so that a burst on a currency pair
+// only delays the currency pairs of the same shard. The order of the messages of a currency pair is kept
+// as they are all in the same shard. Conflated updates and heartbeats are published by their own go routine.
+func (m *Manager) Run(ctx context.Context) error {
+	slog.Info("Starting Push Handler", "Workers", len(m.OutQs()))
+
+	var workers sync.WaitGroup
+
+	for _, outQ := range m.OutQs() {
+		workers.Go(func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case message := <-outQ:
+					m.handlePushMessage(message)
+				}
+			}
+		})
+	}
+
+	workers.Go(func() {
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+
+		conflationTicker := time.NewTicker(conflationTick)
+		defer conflationTicker.Stop()
 
 		for {
-			event := <-m.OutQ()
-			m.handlePushEvent(event)
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-conflationTicker.C:
+				m.publishConflated(now)
+			case <-ticker.C:
+				m.sendHeartbeats()
+			}
 		}
-	}()
+	})
+
+	workers.Wait()
+	slog.Info("Push Handler Stopped")
+
+	return nil
 }
 
-func (m *Manager) handlePushEvent(event *dtos.EventUpdate) {
-	message, err := json.Marshal(event)
+func (m *Manager) handlePushMessage(message *dtos.Message) {
+	ss := m.symbol(message.Symbol)
+	if ss == nil {
+		return
+	}
 
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	switch message.Type {
+	case dtos.TypeDelta:
+		m.handleDelta(ss, message)
+	case dtos.TypeBBO, dtos.TypeAnalytics:
+		m.handleState(ss, message, stateStreams[message.Type])
+	case dtos.TypeResync:
+		// the subscribers will get a new snapshot with the next delta
+		clear(ss.views)
+		clear(ss.state)
+
+		for _, s := range ss.subs {
+			s.lastUpdateId = 0
+			s.latest = nil
+
+			if s.pending != nil {
+				s.pending = newPendingDelta(s.options.Interval)
+			}
+		}
+
+		m.broadcast(ss.subs, message)
+	default:
+		m.broadcast(ss.subs, message)
+	}
+}
+
+// broadcast sends the message to the users of the subscriptions, encoded once per encoding.
+func (m *Manager) broadcast(subs []*Subscription, message *dtos.Message) {
+	f := newFrame(message)
+
+	for _, s := range subs {
+		s.user.Send(f)
+	}
+}
+
+func (m *Manager) handleDelta(ss *symbolSubs, message *dtos.Message) {
+	// the delta is encoded once per encoding for all the subscribers
+	f := newFrame(message)
+
+	viewSubs := make(map[viewKey][]*Subscription)
+
+	for _, s := range ss.subs {
+		if s.options.Stream != StreamDepth {
+			continue
+		}
+
+		if key, ok := s.viewKey(message.Symbol); ok {
+			viewSubs[key] = append(viewSubs[key], s)
+
+			continue
+		}
+
+		if s.lastUpdateId == 0 {
+			// send the order book. Without it, the snapshot is retried with the next delta
+			if s.lastUpdateId = m.sendSnapshot(s.user, message.Symbol); s.lastUpdateId == 0 {
+				continue
+			}
+		}
+
+		if message.Seq <= s.lastUpdateId {
+			continue
+		}
+
+		if s.pending != nil {
+			s.pending.merge(message.Seq, message.Ts, message.Data.(*dtos.EventUpdate))
+
+			continue
+		}
+
+		s.lastUpdateId = message.Seq
+		s.user.Send(f)
+	}
+
+	for key, subs := range viewSubs {
+		m.handleViewDelta(ss, message, key, subs)
+	}
+
+	metrics.PushLatency.WithLabelValues(message.Symbol).Observe(time.Since(time.UnixMilli(message.Ts)).Seconds())
+}
+
+// handleState pushes the state message to the subscribers of the stream.
+// Conflated subscribers get the latest state on the next publish.
+func (m *Manager) handleState(ss *symbolSubs, message *dtos.Message, stream Stream) {
+	ss.state[stream] = message
+
+	f := newFrame(message)
+
+	for _, s := range ss.subs {
+		if s.options.Stream != stream || message.Seq <= s.lastUpdateId {
+			continue
+		}
+
+		if s.pending != nil {
+			s.latest = message
+
+			continue
+		}
+
+		s.lastUpdateId = message.Seq
+		s.user.Send(f)
+	}
+}
+
+// handleViewDelta moves the top-N or grouped window of the currency pair and pushes the levels changed
+// to the subscribers.
+func (m *Manager) handleViewDelta(ss *symbolSubs, message *dtos.Message, key viewKey, subs []*Subscription) {
+	snapshot, err := m.viewSnapshot(key)
 	if err != nil {
-		slog.Error("error on parsing push event to json", "Error", err)
+		slog.Error("error on getting order book", "Currency", message.Symbol, "Error", err)
+
+		return
 	}
 
-	for _, u := range m.subs[event.Symbol] {
-		if u.lastUpdateId == 0 {
-			// send the order book
-			ob, lastUpdateId := m.GetOrderBook(event.Symbol)
-			m.sendWSMessage(u.conn, ob)
-			u.lastUpdateId = lastUpdateId //set order book id
+	view, ok := ss.views[key]
+
+	if !ok {
+		view = newDepthView(key.depth)
+		view.reset(snapshot)
+		ss.views[key] = view
+	}
+
+	prevSeq := view.seq
+
+	var deltaFrame, snapshotFrame *frame
+
+	if delta, changed := view.update(snapshot); changed {
+		delta.EventTime = int(message.Ts)
+		delta.Symbol = message.Symbol
+
+		deltaFrame = newFrame(&dtos.Message{
+			Type:    dtos.TypeDelta,
+			Symbol:  message.Symbol,
+			Seq:     view.seq,
+			PrevSeq: prevSeq,
+			Ts:      message.Ts,
+			Data:    delta,
+		})
+	}
+
+	for _, s := range subs {
+		if s.lastUpdateId == 0 {
+			// send the current window of the order book, encoded once for the new subscribers
+			if snapshotFrame == nil {
+				snapshotFrame = newFrame(&dtos.Message{
+					Type:   dtos.TypeSnapshot,
+					Symbol: message.Symbol,
+					Seq:    view.seq,
+					Ts:     time.Now().UnixMilli(),
+					Data:   view.snapshot,
+				})
+			}
+
+			s.user.Send(snapshotFrame)
+			s.lastUpdateId = view.seq
+
+			continue
 		}
 
-		if event.FinalUpdateId > u.lastUpdateId {
-			u.lastUpdateId = event.FinalUpdateId
-			m.sendWSMessage(u.conn, message)
+		// conflated subscribers get the window on the next publish
+		if s.pending == nil && deltaFrame != nil && view.seq > s.lastUpdateId {
+			s.lastUpdateId = view.seq
+			s.user.Send(deltaFrame)
 		}
 	}
 }
 
-func (m *Manager) sendWSMessage(conn *websocket.Conn, message []byte) {
-	err := conn.WriteMessage(websocket.TextMessage, message)
+// publishConflated publishes the coalesced updates of the conflated subscriptions whose interval has elapsed.
+// Full book subscribers get one delta, top-N subscribers get one snapshot of the window
+// and the state stream subscribers get the latest state.
+func (m *Manager) publishConflated(now time.Time) {
+	m.mu.RLock()
+	symbols := make(map[string]*symbolSubs, len(m.symbols))
+	maps.Copy(symbols, m.symbols)
+	m.mu.RUnlock()
+
+	for currency, ss := range symbols {
+		ss.mu.Lock()
+		m.publishSymbolConflated(ss, currency, now)
+		ss.mu.Unlock()
+	}
+}
+
+func (m *Manager) publishSymbolConflated(ss *symbolSubs, currency string, now time.Time) {
+	for _, s := range ss.subs {
+		if s.pending == nil || !s.pending.due(now, s.options.Interval) {
+			continue
+		}
+
+		if s.options.Stream != StreamDepth {
+			if s.latest != nil && s.latest.Seq > s.lastUpdateId {
+				m.sendMessage(s.user, s.latest)
+				s.lastUpdateId = s.latest.Seq
+			}
+
+			continue
+		}
+
+		if s.lastUpdateId == 0 {
+			continue
+		}
+
+		if key, ok := s.viewKey(currency); ok {
+			view, ok := ss.views[key]
+			if !ok || view.seq <= s.lastUpdateId {
+				continue
+			}
+
+			m.sendMessage(s.user, &dtos.Message{
+				Type:   dtos.TypeSnapshot,
+				Symbol: currency,
+				Seq:    view.seq,
+				Ts:     now.UnixMilli(),
+				Data:   view.snapshot,
+			})
+
+			s.lastUpdateId = view.seq
+
+			continue
+		}
+
+		if message := s.pending.flush(currency, s.lastUpdateId); message != nil {
+			m.sendMessage(s.user, message)
+			s.lastUpdateId = message.Seq
+		}
+	}
+}
+
+// viewSnapshot returns the current snapshot of the order book for a window.
+func (m *Manager) viewSnapshot(key viewKey) (*dtos.Snapshot, error) {
+	if key.group > 0 {
+		return m.GetGroupedOrderBook(key.currency, key.group, key.depth)
+	}
+
+	return m.GetOrderBook(key.currency, key.depth)
+}
+
+// sendSnapshot sends the latest order book to the user and returns its last update id.
+// It returns 0 when the order book is unknown or not synced, and nothing is sent.
+func (m *Manager) sendSnapshot(user *User, currency string) int {
+	snapshot, err := m.GetOrderBook(currency, 0)
 	if err != nil {
-		slog.Error("Error on Writing to Websocket", "Error", err)
+		slog.Error("error on getting order book", "Currency", currency, "Error", err)
+
+		return 0
+	}
+
+	m.sendMessage(user, &dtos.Message{
+		Type:   dtos.TypeSnapshot,
+		Symbol: currency,
+		Seq:    snapshot.LastUpdateId,
+		Ts:     time.Now().UnixMilli(),
+		Data:   snapshot,
+	})
+
+	return snapshot.LastUpdateId
+}
+
+func (m *Manager) sendHeartbeats() {
+	f := newFrame(&dtos.Message{
+		Type: dtos.TypeHeartbeat,
+		Ts:   time.Now().UnixMilli(),
+	})
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, u := range m.users {
+		u.Send(f)
 	}
 }
+
+func (m *Manager) sendMessage(user *User, message *dtos.Message) {
+	user.Send(newFrame(message))
+}
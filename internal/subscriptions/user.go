@@ -0,0 +1,290 @@
+package subscriptions
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ob-manager/internal/dtos"
+	"ob-manager/internal/encoding"
+	"ob-manager/internal/metrics"
+
+	"github.com/gorilla/websocket"
+)
+
+// ConnOptions configure how the messages are written to a user.
+type ConnOptions struct {
+	Encoding encoding.Encoding
+	// CompressionThreshold is the minimum size of the messages compressed when the connection negotiated
+	// permessage-deflate. Smaller messages are sent uncompressed.
+	CompressionThreshold int
+	// WireBytes returns the bytes written to the network connection, after compression. It is optional.
+	WireBytes func() int64
+	// PingInterval is the interval of the pings sent to the connection. 0 sends no ping.
+	PingInterval time.Duration
+}
+
+// writeTimeout is the maximum time to write a message to a connection. A connection
+// that does not read its messages fills its send buffer and is closed as a slow consumer.
+const writeTimeout = 10 * time.Second
+
+// User is a downstream websocket connection. The messages are buffered and written by a writer go routine,
+// so that a slow connection does not delay the other subscribers of its currency pairs.
+type User struct {
+	conn    *websocket.Conn
+	options ConnOptions
+	send    chan encodedFrame
+	done    chan struct{}
+	once    sync.Once
+
+	// draining asks the writer to flush the buffer until drainDeadline and to close the connection.
+	draining      chan struct{}
+	drainOnce     sync.Once
+	drainDeadline time.Time
+	// finished is closed when the writer returns.
+	finished chan struct{}
+	// dropped are the messages sent after the drain started.
+	dropped atomic.Int64
+
+	// payloadBytes are the bytes of the messages written, before compression.
+	payloadBytes atomic.Int64
+}
+
+func NewUser(conn *websocket.Conn, options ConnOptions, buffer int) *User {
+	u := &User{
+		conn:     conn,
+		options:  options,
+		send:     make(chan encodedFrame, buffer),
+		done:     make(chan struct{}),
+		draining: make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+
+	go u.writeMessages()
+
+	return u
+}
+
+// Send buffers a frame for the connection in the encoding of the user. The frame is shared with the other users,
+// so it is encoded and framed once per encoding. The connection is closed when its buffer is full.
+func (u *User) Send(f *frame) {
+	if u.closed() {
+		return
+	}
+
+	if u.isDraining() {
+		u.dropped.Add(1)
+
+		return
+	}
+
+	encoded, err := f.encode(u.options.Encoding)
+	if err != nil {
+		slog.Error("Error on encoding message", "Type", f.message.Type, "Encoding", u.options.Encoding, "Error", err)
+
+		return
+	}
+
+	select {
+	case u.send <- encoded:
+	default:
+		slog.Error("Send buffer full, closing slow connection.", "Remote", u.conn.RemoteAddr())
+		metrics.SlowConsumers.Inc()
+		u.close()
+
+		// the reader of the connection fails and removes the user
+		if err := u.conn.Close(); err != nil {
+			slog.Error("Error on Closing the Connection", "Error", err)
+		}
+	}
+}
+
+// close stops the writer go routine and reports the compression of the connection.
+func (u *User) close() {
+	u.once.Do(func() {
+		close(u.done)
+
+		payload := u.payloadBytes.Load()
+		if payload == 0 || u.options.WireBytes == nil {
+			return
+		}
+
+		wire := u.options.WireBytes()
+		metrics.WSCompressionRatio.Observe(float64(wire) / float64(payload))
+
+		slog.Info("Connection Bytes Written", "Remote", u.conn.RemoteAddr(), "Payload", payload, "Wire", wire)
+	})
+}
+
+// drain asks the writer to write the buffered messages until the deadline and to close the connection
+// with a going away message.
+func (u *User) drain(deadline time.Time) {
+	u.drainOnce.Do(func() {
+		u.drainDeadline = deadline
+		close(u.draining)
+	})
+}
+
+func (u *User) isDraining() bool {
+	select {
+	case <-u.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+func (u *User) closed() bool {
+	select {
+	case <-u.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// writeMessages writes the buffered messages and the pings to the connection. The pongs are handled
+// by the reader of the connection, which closes it when the client stops responding.
+func (u *User) writeMessages() {
+	defer close(u.finished)
+
+	var pings <-chan time.Time
+
+	if u.options.PingInterval > 0 {
+		ticker := time.NewTicker(u.options.PingInterval)
+		defer ticker.Stop()
+
+		pings = ticker.C
+	}
+
+	for {
+		select {
+		case <-u.done:
+			return
+		case <-u.draining:
+			u.flush()
+
+			return
+		case now := <-pings:
+			err := u.conn.WriteControl(websocket.PingMessage, nil, now.Add(writeTimeout))
+			if err != nil {
+				slog.Error("Error on Sending Ping", "Remote", u.conn.RemoteAddr(), "Error", err)
+			}
+		case encoded := <-u.send:
+			if u.closed() {
+				return
+			}
+
+			u.write(encoded, time.Now().Add(writeTimeout))
+		}
+	}
+}
+
+// flush writes the buffered messages until the drain deadline and closes the connection with a going away message.
+// The messages left in the buffer are dropped.
+func (u *User) flush() {
+	// the writer is the only reader of the buffer
+	for len(u.send) > 0 && time.Now().Before(u.drainDeadline) {
+		if !u.write(<-u.send, u.drainDeadline) {
+			break
+		}
+	}
+
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	if err := u.conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second)); err != nil {
+		slog.Error("Error on Sending Close Message", "Remote", u.conn.RemoteAddr(), "Error", err)
+	}
+
+	// the reader of the connection fails and removes the user
+	if err := u.conn.Close(); err != nil {
+		slog.Error("Error on Closing the Connection", "Error", err)
+	}
+}
+
+// write writes a message to the connection and reports whether it succeeded.
+func (u *User) write(encoded encodedFrame, deadline time.Time) bool {
+	// no-op unless the connection negotiated compression
+	u.conn.EnableWriteCompression(encoded.size >= u.options.CompressionThreshold)
+
+	if err := u.conn.SetWriteDeadline(deadline); err != nil {
+		slog.Error("Error on Setting Write Deadline", "Error", err)
+	}
+
+	err := u.conn.WritePreparedMessage(encoded.prepared)
+	if err != nil {
+		slog.Error("Error on Writing to Websocket", "Error", err)
+		metrics.WSWriteErrors.Inc()
+
+		return false
+	}
+
+	u.payloadBytes.Add(int64(encoded.size))
+	metrics.WSPayloadBytes.Add(float64(encoded.size))
+
+	return true
+}
+
+// encodedFrame is a message encoded and framed, with its size before compression.
+type encodedFrame struct {
+	prepared *websocket.PreparedMessage
+	size     int
+}
+
+// frame is a message prepared once per encoding for all the users it is sent to.
+// The prepared messages also compress the message once for all the users negotiating compression.
+type frame struct {
+	message  *dtos.Message
+	encoded  map[encoding.Encoding]encodedFrame
+	failures map[encoding.Encoding]error
+}
+
+func newFrame(message *dtos.Message) *frame {
+	return &frame{
+		message: message,
+	}
+}
+
+// encode returns the message encoded and framed in the given encoding.
+func (f *frame) encode(enc encoding.Encoding) (encodedFrame, error) {
+	if encoded, ok := f.encoded[enc]; ok {
+		return encoded, nil
+	}
+
+	if err, ok := f.failures[enc]; ok {
+		return encodedFrame{}, err
+	}
+
+	encoded, err := prepare(f.message, enc)
+	if err != nil {
+		if f.failures == nil {
+			f.failures = make(map[encoding.Encoding]error)
+		}
+
+		f.failures[enc] = err
+
+		return encodedFrame{}, err
+	}
+
+	if f.encoded == nil {
+		f.encoded = make(map[encoding.Encoding]encodedFrame, 1)
+	}
+
+	f.encoded[enc] = encoded
+
+	return encoded, nil
+}
+
+func prepare(message *dtos.Message, enc encoding.Encoding) (encodedFrame, error) {
+	payload, err := enc.Marshal(message)
+	if err != nil {
+		return encodedFrame{}, err
+	}
+
+	prepared, err := websocket.NewPreparedMessage(enc.FrameType(), payload)
+	if err != nil {
+		return encodedFrame{}, err
+	}
+
+	return encodedFrame{prepared: prepared, size: len(payload)}, nil
+}
@@ -6,9 +6,11 @@ import (
 	"fmt"
 	"log/slog"
 	"net/url"
+	"ob-manager/internal/metrics"
 	"ob-manager/internal/processors"
 	inqueues "ob-manager/internal/queues/in"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -20,10 +22,12 @@ import (
 const (
 	readDeadLineTime = 60 * time.Second
 	maxWait          = 60 * time.Second
+	// closeTimeout is the maximum time to unsubscribe and close the connection when the client stops.
+	closeTimeout = 5 * time.Second
 )
 
 type SnapshotGetter interface {
-	GetSnapshot(ctx context.Context, currPair string) error
+	GetSnapshot(ctx context.Context, proc *processors.Processor) error
 }
 
 type Client struct {
@@ -32,32 +36,109 @@ type Client struct {
 	procManager *processors.Manager
 
 	conn         *websocket.Conn
+	connected    atomic.Bool
+	symbols      []string
 	requests     chan []byte
 	unqId        atomic.Int32
 	bufferedMsgs chan []byte
+
+	// snapshots cancels the snapshot fetch in flight of each currency pair, replaced by the next fetch.
+	snapshotsMu sync.Mutex
+	snapshots   map[string]context.CancelFunc
+
+	// closing stops the reconnections, quit stops the writer of the requests and stopped is closed when it returns.
+	// mu guards the connection, replaced on each reconnection, and orders it with the closing.
+	mu      sync.Mutex
+	closing atomic.Bool
+	quit    chan struct{}
+	stopped chan struct{}
 }
 
-func NewClient(requests chan []byte, inQ *inqueues.InQManager, proc *processors.Manager) *Client {
+// NewClient creates the client of the binance server. It connects when Run is called.
+func NewClient(requests chan []byte, inQ *inqueues.InQManager, proc *processors.Manager, symbols []string) *Client {
 	restC := NewRestClient(proc)
 	bufferSize := 50000
 
-	c := Client{
+	return &Client{
 		requests:     requests,
 		bufferedMsgs: make(chan []byte, bufferSize),
 		inQ:          inQ,
 		restC:        restC,
 		procManager:  proc,
+		symbols:      symbols,
+		snapshots:    make(map[string]context.CancelFunc),
+		quit:         make(chan struct{}),
+		stopped:      make(chan struct{}),
 	}
+}
+
+// Run connects with the binance server and processes its messages until the context is done, reconnecting when the
+// connection fails. The streams are then unsubscribed and the connection is closed.
+func (c *Client) Run(ctx context.Context) error {
+	var tasks sync.WaitGroup
+
+	tasks.Go(c.sendRequests)
+	tasks.Go(func() { c.processMessage(ctx) })
+	tasks.Go(func() { c.resyncBooks(ctx) })
+	tasks.Go(func() { c.connect(ctx) })
+
+	<-ctx.Done()
+
+	closeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), closeTimeout)
+	defer cancel()
 
-	go c.sendRequests()
+	c.closeConnection(closeCtx)
+	tasks.Wait()
 
-	go c.processMessage()
+	slog.Info("Binance Client Stopped")
+
+	return nil
+}
+
+// resyncBooks restarts the processors of the order books requested to resync and fetches new snapshots.
+func (c *Client) resyncBooks(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case request := <-c.procManager.ResyncRequests():
+			if !c.IsConnected() {
+				// the books are resynced on the reconnection
+				continue
+			}
+
+			slog.Info("Resyncing Order Book", "Currency", request.Symbol, "Reason", request.Reason)
+
+			c.fetchSnapshot(ctx, c.procManager.RestartProcessor(request.Symbol, request.Reason))
+		}
+	}
+}
+
+// fetchSnapshot fetches the snapshot of the order book of a processor. The fetch still in flight for the previous
+// processor of the currency pair is cancelled, as its snapshot would be dropped.
+func (c *Client) fetchSnapshot(ctx context.Context, proc *processors.Processor) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	c.snapshotsMu.Lock()
+	if prev, ok := c.snapshots[proc.Currency()]; ok {
+		prev()
+	}
+
+	c.snapshots[proc.Currency()] = cancel
+	c.snapshotsMu.Unlock()
+
+	go func() {
+		defer cancel()
 
-	return &c
+		err := c.restC.GetSnapshot(ctx, proc)
+		if err != nil {
+			slog.Error("Error in getting snapshot", "Currency", proc.Currency(), "Error", err)
+		}
+	}()
 }
 
-// StartClient connects with the binance server and reads responses.
-func (c *Client) StartClient(ctx context.Context) {
+// connect connects with the binance server and reads responses, until the client is closed.
+func (c *Client) connect(ctx context.Context) {
 	u := url.URL{
 		Scheme: wssStream,
 		Host:   binanceUrl,
@@ -66,64 +147,176 @@ func (c *Client) StartClient(ctx context.Context) {
 
 	waitTime := 1 * time.Second
 
-	go func() {
-		for {
-			slog.Info("connecting to websocket", "url", u.String())
+	for {
+		slog.Info("connecting to websocket", "url", u.String())
 
-			conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+		conn, _, err := websocket.DefaultDialer.DialContext(ctx, u.String(), nil)
 
-			if err != nil {
-				slog.Error("Websocket connectivity issue", "Error", err)
-			} else {
-				slog.Info("Connected to websocket", "url", u.String())
+		if err != nil {
+			slog.Error("Websocket connectivity issue", "Error", err)
+		} else {
+			slog.Info("Connected to websocket", "url", u.String())
+
+			waitTime = 1 * time.Second //reset wait time
+
+			if !c.setConnection(conn) {
+				return
+			}
 
-				waitTime = 1 * time.Second //reset wait time
+			c.connected.Store(true)
+			metrics.UpstreamConnected.Set(1)
 
-				c.conn = conn
+			// subscribe to default currency list
+			c.subscribeToCurrencies(ctx)
 
-				// subscribe to default currency list
-				c.subscribeToCurrencies(ctx)
+			err = c.readWSMessages(ctx, conn)
+			if c.closing.Load() {
+				slog.Info("Websocket connection closed", "url", u.String())
+				c.connected.Store(false)
+				metrics.UpstreamConnected.Set(0)
 
-				err = c.readWSMessages()
-				if err != nil {
-					slog.Error("Websocket read error", "Error", err)
-					c.procManager.ResetProcessors()
-				}
+				return
 			}
 
-			select {
-			case <-ctx.Done():
-				break
-			case <-time.After(waitTime):
-				waitTime = min(waitTime*2, maxWait)
+			if err != nil {
+				slog.Error("Websocket read error", "Error", err)
+				c.procManager.ResetProcessors()
 			}
+
+			c.connected.Store(false)
+			metrics.UpstreamConnected.Set(0)
 		}
-	}()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(waitTime):
+			waitTime = min(waitTime*2, maxWait)
+		}
+
+		metrics.UpstreamReconnects.Inc()
+	}
 }
 
-func (c *Client) CloseConnection() {
-	close(c.requests)
+// setConnection keeps the new connection. The connection is closed and false is returned if the client is closing.
+func (c *Client) setConnection(conn *websocket.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	err := c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	if c.closing.Load() {
+		if err := conn.Close(); err != nil {
+			slog.Error("Error on closing websocket", "Error", err)
+		}
 
-	if err != nil {
-		slog.Error("Error on writing close request to websocket", "Error", err)
+		return false
 	}
+
+	c.conn = conn
+
+	return true
 }
 
+// connection returns the current websocket connection, nil before the first one.
+func (c *Client) connection() *websocket.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.conn
+}
+
+// IsConnected reports whether the websocket connection with the binance server is up.
+func (c *Client) IsConnected() bool {
+	return c.connected.Load()
+}
+
+// closeConnection unsubscribes from the currency pairs and closes the websocket connection with the binance server,
+// waiting for the requests to be written until the context is done. The client does not reconnect afterward.
+func (c *Client) closeConnection(ctx context.Context) {
+	c.mu.Lock()
+	c.closing.Store(true)
+	conn := c.conn
+	c.mu.Unlock()
+
+	if c.IsConnected() {
+		request, err := c.streamsRequest(unsubscribe, c.symbols)
+		if err != nil {
+			slog.Error("Error on parsing unsubscription request", "Error", err)
+		}
+
+		select {
+		case c.requests <- request:
+		case <-ctx.Done():
+		}
+	}
+
+	// the writer sends the close message after the pending request
+	close(c.quit)
+
+	select {
+	case <-c.stopped:
+	case <-ctx.Done():
+	}
+
+	if conn != nil {
+		if err := conn.Close(); err != nil {
+			slog.Error("Error on closing websocket", "Error", err)
+		}
+	}
+}
+
+// sendRequests writes the requests to the websocket connection, until the connection is closed.
 func (c *Client) sendRequests() {
+	defer close(c.stopped)
+
 	for {
-		request := <-c.requests
-		slog.Info("Sending Web Socket Request", "Request", request)
-		err := c.conn.WriteMessage(websocket.TextMessage, request)
+		select {
+		case <-c.quit:
+			conn := c.connection()
+			if conn == nil || !c.IsConnected() {
+				return
+			}
 
-		if err != nil {
-			slog.Error("Error on sending subscription request", "Error", err)
+			closeMessage := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+			if err := conn.WriteMessage(websocket.CloseMessage, closeMessage); err != nil {
+				slog.Error("Error on writing close request to websocket", "Error", err)
+			}
+
+			return
+		case request := <-c.requests:
+			slog.Info("Sending Web Socket Request", "Request", string(request))
+
+			// the requests are sent once connected, the connection of a request may be replaced meanwhile
+			conn := c.connection()
+			if conn == nil {
+				slog.Error("Error on sending subscription request", "Error", "not connected")
+
+				continue
+			}
+
+			err := conn.WriteMessage(websocket.TextMessage, request)
+			if err != nil {
+				slog.Error("Error on sending subscription request", "Error", err)
+			}
 		}
 	}
 }
 
-func (c *Client) processMessage() {
+// streamsRequest returns a request to the depth streams of the currency pairs.
+func (c *Client) streamsRequest(method string, currencyPairs []string) ([]byte, error) {
+	params := make([]string, 0, len(currencyPairs))
+
+	for _, currencyPair := range currencyPairs {
+		params = append(params, fmt.Sprintf(depthStr, strings.ToLower(currencyPair)))
+	}
+
+	return json.Marshal(dtos.SubscriptionRequest{
+		Method: method,
+		Params: params,
+		Id:     c.unqId.Add(1),
+	})
+}
+
+func (c *Client) processMessage(ctx context.Context) {
 	slog.Info("started binance message processors")
 
 	var rawMap map[string]interface{}
@@ -136,7 +329,13 @@ func (c *Client) processMessage() {
 
 		slog.Debug("Waiting for messages from binance")
 
-		message := <-c.bufferedMsgs
+		var message []byte
+
+		select {
+		case <-ctx.Done():
+			return
+		case message = <-c.bufferedMsgs:
+		}
 
 		err := json.Unmarshal(message, &rawMap)
 		if err != nil {
@@ -171,30 +370,20 @@ func (c *Client) processMessage() {
 	}
 }
 
-// subscribeToCurrencies todo get currencies list from configurations.
+// subscribeToCurrencies subscribes to the configured currency pairs.
 func (c *Client) subscribeToCurrencies(ctx context.Context) {
-	currencies := []string{"BTCUSDT", "ETHUSDT"}
-
-	for _, currency := range currencies {
+	for _, currency := range c.symbols {
 		slog.Info("Subscribing", "currency", currency)
 
 		go func(curr string) {
 			err := c.subscribeToCurrPair(curr)
 			if err != nil {
-				slog.Error("Error in subscribing", "Currency", currency, err)
+				slog.Error("Error in subscribing", "Currency", curr, "Error", err)
 			}
 		}(currency)
 
-		go func(ctx context.Context, curr string) {
-			err := c.restC.GetSnapshot(ctx, curr)
-			if err != nil {
-				slog.Error("Error in getting snapshot", "Currency", currency, err)
-			}
-		}(ctx, currency)
-
-		go func(curr string) {
-			c.procManager.StartProcessor(curr)
-		}(currency)
+		// the snapshot populates the order book of the new processor
+		c.fetchSnapshot(ctx, c.procManager.StartProcessor(currency))
 	}
 }
 
@@ -215,19 +404,22 @@ func (c *Client) subscribeToCurrPair(currencyPair string) error {
 		slog.Error("Error on parsing subscription request", "Error", err)
 	}
 
-	c.requests <- subsRequest
+	select {
+	case c.requests <- subsRequest:
+	case <-c.quit:
+	}
 
 	return nil
 }
 
-func (c *Client) readWSMessages() error {
-	err := c.conn.SetReadDeadline(time.Now().Add(readDeadLineTime))
+func (c *Client) readWSMessages(ctx context.Context, conn *websocket.Conn) error {
+	err := conn.SetReadDeadline(time.Now().Add(readDeadLineTime))
 	if err != nil {
 		slog.Error("Error on setting read deadline", "Error", err)
 	}
 
-	c.conn.SetPongHandler(func(string) error {
-		err := c.conn.SetReadDeadline(time.Now().Add(readDeadLineTime))
+	conn.SetPongHandler(func(string) error {
+		err := conn.SetReadDeadline(time.Now().Add(readDeadLineTime))
 		if err != nil {
 			slog.Error("Error on setting read deadline", "Error", err)
 		}
@@ -236,21 +428,25 @@ func (c *Client) readWSMessages() error {
 	})
 
 	for {
-		_, message, err := c.conn.ReadMessage()
+		_, message, err := conn.ReadMessage()
 		if err != nil {
 			slog.Error("Error on reading Websocket Message", "Error", err)
 
 			return err
 		}
 
-		slog.Info("WS message received.", "Message", message)
+		slog.Debug("WS message received.", "Message", message)
 
 		if len(message) > 0 {
-			c.bufferedMsgs <- message
+			select {
+			case c.bufferedMsgs <- message:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 		}
 
 		// extend read deadline
-		err = c.conn.SetReadDeadline(time.Now().Add(readDeadLineTime))
+		err = conn.SetReadDeadline(time.Now().Add(readDeadLineTime))
 		if err != nil {
 			slog.Error("Error on setting read deadline", "Error", err)
 		}
@@ -258,6 +454,7 @@ func (c *Client) readWSMessages() error {
 }
 
 func (c *Client) processMarketDepthUpdate(eventUpdate dtos.EventUpdate) {
+	metrics.UpstreamMessages.WithLabelValues(eventUpdate.Symbol).Inc()
 	c.inQ.AddToQueue(&eventUpdate)
 	slog.Debug("adding event to the channel")
 }
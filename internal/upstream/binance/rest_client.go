@@ -21,8 +21,11 @@ func NewRestClient(proc *processors.Manager) *RestClient {
 	}
 }
 
-// GetSnapshot to get the market depth for a currency pair and populate the order book.
-func (c *RestClient) GetSnapshot(ctx context.Context, currPair string) error {
+// GetSnapshot to get the market depth for the currency pair of a processor and populate its order book.
+// The snapshot is dropped if the processor was replaced meanwhile, its book waiting for another snapshot.
+func (c *RestClient) GetSnapshot(ctx context.Context, proc *processors.Processor) error {
+	currPair := proc.Currency()
+
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf(snapshotURL, currPair), nil)
 	if err != nil {
 		slog.Error("Error on Creating New GET Request", "curr pair", currPair, "Error", err)
@@ -63,24 +66,30 @@ func (c *RestClient) GetSnapshot(ctx context.Context, currPair string) error {
 		return err
 	}
 
-	c.updateSnapshot(currPair, snapshot)
+	if c.proc.Processor(currPair) != proc {
+		slog.Info("Discarding Snapshot of a Replaced Processor", "curr pair", currPair)
+
+		return nil
+	}
+
+	c.updateSnapshot(proc, snapshot)
 
 	return nil
 }
 
-func (c *RestClient) updateSnapshot(currPair string, snapshot *dtos.Snapshot) {
+func (c *RestClient) updateSnapshot(proc *processors.Processor, snapshot *dtos.Snapshot) {
 	// process bids
-	c.processBids(currPair, snapshot.Bids)
+	proc.UpdateBids(c.processBids(proc.Currency(), snapshot.Bids))
 
 	// process asks
-	c.processAsks(currPair, snapshot.Asks)
+	proc.UpdateAsks(c.processAsks(proc.Currency(), snapshot.Asks))
 
 	// flag snapshot populated. start consuming push events.
-	c.proc.SetOrderBookReady(currPair, snapshot.LastUpdateId)
+	proc.SetReady(snapshot.LastUpdateId)
 }
 
-// process bids and populate the order book.
-func (c *RestClient) processBids(currPair string, bids [][]string) {
+// process bids to populate the order book.
+func (c *RestClient) processBids(currPair string, bids [][]string) map[float64]float64 {
 	bidsMap := make(map[float64]float64)
 
 	for _, bidEntry := range bids {
@@ -97,11 +106,11 @@ func (c *RestClient) processBids(currPair string, bids [][]string) {
 		bidsMap[price] = qty
 	}
 
-	c.proc.UpdateBids(currPair, bidsMap)
+	return bidsMap
 }
 
-// process asks and populate the order book.
-func (c *RestClient) processAsks(currPair string, asks [][]string) {
+// process asks to populate the order book.
+func (c *RestClient) processAsks(currPair string, asks [][]string) map[float64]float64 {
 	asksMap := make(map[float64]float64)
 
 	for _, askEntry := range asks {
@@ -118,5 +127,5 @@ func (c *RestClient) processAsks(currPair string, asks [][]string) {
 		asksMap[price] = qty
 	}
 
-	c.proc.UpdateAsks(currPair, asksMap)
+	return asksMap
 }
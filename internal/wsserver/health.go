@@ -0,0 +1,71 @@
+package wsserver
+
+import (
+	"net/http"
+	"ob-manager/internal/dtos"
+)
+
+type UpstreamState interface {
+	IsConnected() bool
+}
+
+type StatusGetter interface {
+	BookStatus(curr string) dtos.SymbolStatus
+}
+
+type SubscriberCounter interface {
+	SubscriberCount(currency string) int
+}
+
+// HealthHandler serves the liveness, readiness and status probes.
+type HealthHandler struct {
+	upstream UpstreamState
+	books    StatusGetter
+	subs     SubscriberCounter
+	symbols  []string
+}
+
+// healthzHandler reports the process is alive.
+func (h *HealthHandler) healthzHandler(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// readyzHandler reports ready when the upstream is connected and all the configured books are live.
+func (h *HealthHandler) readyzHandler(w http.ResponseWriter, _ *http.Request) {
+	status := h.status()
+	if !status.Ready {
+		writeJSON(w, http.StatusServiceUnavailable, status)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+// statusHandler returns the state of the upstream and of each configured book.
+func (h *HealthHandler) statusHandler(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, h.status())
+}
+
+func (h *HealthHandler) status() *dtos.ServiceStatus {
+	status := &dtos.ServiceStatus{
+		UpstreamConnected: h.upstream.IsConnected(),
+		Symbols:           make([]dtos.SymbolStatus, 0, len(h.symbols)),
+	}
+
+	status.Ready = status.UpstreamConnected
+
+	for _, symbol := range h.symbols {
+		symbolStatus := h.books.BookStatus(symbol)
+		symbolStatus.Subscribers = h.subs.SubscriberCount(symbol)
+
+		if symbolStatus.State != dtos.BookLive {
+			status.Ready = false
+		}
+
+		status.Symbols = append(status.Symbols, symbolStatus)
+	}
+
+	return status
+}
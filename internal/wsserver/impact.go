@@ -0,0 +1,43 @@
+package wsserver
+
+import (
+	"fmt"
+	"math"
+	"ob-manager/internal/dtos"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseImpactRequest validates the side and the quantity of a market impact request.
+func parseImpactRequest(sideArg, qtyArg string) (dtos.Side, float64, error) {
+	side := dtos.Side(strings.ToLower(sideArg))
+	if side != dtos.SideBuy && side != dtos.SideSell {
+		return "", 0, fmt.Errorf("side must be %s or %s", dtos.SideBuy, dtos.SideSell)
+	}
+
+	qty, err := strconv.ParseFloat(qtyArg, 64)
+	if err != nil || qty <= 0 || math.IsNaN(qty) || math.IsInf(qty, 0) {
+		return "", 0, fmt.Errorf("qty must be a positive number")
+	}
+
+	return side, qty, nil
+}
+
+// impactMessage estimates the fill of a market order and wraps it in an impact message.
+func impactMessage(books ImpactGetter, symbol string, side dtos.Side, qty float64, id string) (*dtos.Message, error) {
+	impact, lastUpdateId, err := books.GetImpact(symbol, side, qty)
+	if err != nil {
+		return nil, err
+	}
+
+	impact.Id = id
+
+	return &dtos.Message{
+		Type:   dtos.TypeImpact,
+		Symbol: symbol,
+		Seq:    lastUpdateId,
+		Ts:     time.Now().UnixMilli(),
+		Data:   impact,
+	}, nil
+}
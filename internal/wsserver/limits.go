@@ -0,0 +1,157 @@
+package wsserver
+
+import (
+	"net"
+	"net/http"
+	"ob-manager/internal/auth"
+	"ob-manager/internal/config"
+	"ob-manager/internal/metrics"
+	"ob-manager/internal/subscriptions"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// reasons of the rejections, used as metric labels.
+const (
+	reasonIP            = "ip"
+	reasonKey           = "key"
+	reasonSubscriptions = "subscriptions"
+	reasonRate          = "rate"
+)
+
+// connLimiter counts the connections by IP address and by authenticated subject.
+type connLimiter struct {
+	limits config.Limits
+
+	mu   sync.Mutex
+	ips  map[string]int
+	keys map[string]int
+}
+
+func newConnLimiter(limits config.Limits) *connLimiter {
+	return &connLimiter{
+		limits: limits,
+		ips:    make(map[string]int),
+		keys:   make(map[string]int),
+	}
+}
+
+// acquire reserves a connection for the client. It returns the reason of the rejection when a quota is reached.
+// The anonymous clients have no subject quota.
+func (l *connLimiter) acquire(ip string, identity *auth.Identity) (reason string, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limits.MaxConnsPerIP > 0 && l.ips[ip] >= l.limits.MaxConnsPerIP {
+		metrics.RejectedConnections.WithLabelValues(reasonIP).Inc()
+
+		return reasonIP, false
+	}
+
+	if key, limited := l.key(identity); limited && l.keys[key] >= l.limits.MaxConnsPerKey {
+		metrics.RejectedConnections.WithLabelValues(reasonKey).Inc()
+
+		return reasonKey, false
+	}
+
+	l.ips[ip]++
+
+	if key, limited := l.key(identity); limited {
+		l.keys[key]++
+	}
+
+	return "", true
+}
+
+// release frees the connection reserved for the client.
+func (l *connLimiter) release(ip string, identity *auth.Identity) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.ips[ip]--; l.ips[ip] <= 0 {
+		delete(l.ips, ip)
+	}
+
+	if key, limited := l.key(identity); limited {
+		if l.keys[key]--; l.keys[key] <= 0 {
+			delete(l.keys, key)
+		}
+	}
+}
+
+func (l *connLimiter) key(identity *auth.Identity) (string, bool) {
+	return identity.Subject, l.limits.MaxConnsPerKey > 0 && identity.Subject != auth.AnonymousSubject
+}
+
+// remoteIP returns the IP address of the client of the request.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+type subKey struct {
+	symbol string
+	stream subscriptions.Stream
+}
+
+// commandQuota enforces the command rate and the subscriptions limit of a connection.
+// It is used by the reader of the connection only.
+type commandQuota struct {
+	limits     config.Limits
+	rate       *rate.Limiter
+	subs       map[subKey]struct{}
+	violations int
+}
+
+func newCommandQuota(limits config.Limits) *commandQuota {
+	limit := rate.Limit(limits.CommandRate)
+	if limits.CommandRate == 0 {
+		limit = rate.Inf
+	}
+
+	return &commandQuota{
+		limits: limits,
+		rate:   rate.NewLimiter(limit, max(limits.CommandBurst, 1)),
+		subs:   make(map[subKey]struct{}),
+	}
+}
+
+// allowCommand takes a token of the command bucket.
+func (q *commandQuota) allowCommand() bool {
+	return q.rate.Allow()
+}
+
+// allowSubscription reports whether the connection may subscribe to the stream. Replacing a subscription is allowed.
+func (q *commandQuota) allowSubscription(symbol string, stream subscriptions.Stream) bool {
+	if _, ok := q.subs[subKey{symbol: symbol, stream: stream}]; ok {
+		return true
+	}
+
+	return q.limits.MaxSubscriptions == 0 || len(q.subs) < q.limits.MaxSubscriptions
+}
+
+func (q *commandQuota) subscribed(symbol string, stream subscriptions.Stream) {
+	q.subs[subKey{symbol: symbol, stream: stream}] = struct{}{}
+}
+
+// unsubscribed forgets a subscription. An empty stream forgets all the subscriptions to the currency pair.
+func (q *commandQuota) unsubscribed(symbol string, stream subscriptions.Stream) {
+	for key := range q.subs {
+		if key.symbol == symbol && (stream == "" || key.stream == stream) {
+			delete(q.subs, key)
+		}
+	}
+}
+
+// violation counts a rejected command and reports whether the connection must be closed.
+func (q *commandQuota) violation(reason string) (disconnect bool) {
+	metrics.ThrottledCommands.WithLabelValues(reason).Inc()
+	q.violations++
+
+	return q.limits.MaxViolations > 0 && q.violations >= q.limits.MaxViolations
+}
@@ -0,0 +1,45 @@
+package wsserver
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"ob-manager/internal/metrics"
+	"sync/atomic"
+)
+
+// meteredConn counts the bytes written to a downstream connection, after compression and framing.
+type meteredConn struct {
+	net.Conn
+	written atomic.Int64
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written.Add(int64(n))
+	metrics.WSWireBytes.Add(float64(n))
+
+	return n, err
+}
+
+// Written returns the bytes written to the connection.
+func (c *meteredConn) Written() int64 {
+	return c.written.Load()
+}
+
+// meteredWriter hands a meteredConn to the websocket upgrader when it hijacks the connection.
+type meteredWriter struct {
+	http.ResponseWriter
+	conn *meteredConn
+}
+
+func (w *meteredWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	w.conn = &meteredConn{Conn: conn}
+
+	return w.conn, brw, nil
+}
@@ -1,18 +1,42 @@
 package wsserver
 
 import (
+	"errors"
+	"fmt"
 	"log/slog"
+	"math"
+	"net"
+	"ob-manager/internal/auth"
+	"ob-manager/internal/config"
+	"ob-manager/internal/dtos"
+	"ob-manager/internal/metrics"
 	"ob-manager/internal/subscriptions"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 type RequestProcessor struct {
 	subsManager *subscriptions.Manager
+	books       BookGetter
+	symbols     []string
+	keepalive   config.Keepalive
+	limits      config.Limits
 }
 
-func (p *RequestProcessor) handleConnection(conn *websocket.Conn) {
+// closeTimeout is the maximum time to send the close message to a connection.
+const closeTimeout = time.Second
+
+// handleConnection reads the commands of a connection until it is closed, fails or stays idle.
+// The connection is idle when it sent no message nor pong within the idle timeout.
+// The subscriptions are restricted to the entitlements of the identity of the client and the commands to the
+// rate limit of the connection. The connection is closed after too many rejected commands.
+func (p *RequestProcessor) handleConnection(conn *websocket.Conn, identity *auth.Identity) {
+	quota := newCommandQuota(p.limits)
+
 	// remove the user from the store when closing the connection
 	defer func() {
 		p.subsManager.RemoveUser(conn)
@@ -23,43 +47,275 @@ func (p *RequestProcessor) handleConnection(conn *websocket.Conn) {
 		}
 	}()
 
+	conn.SetReadLimit(p.keepalive.MaxMessageSize)
+	p.extendDeadline(conn)
+
+	conn.SetPongHandler(func(string) error {
+		p.extendDeadline(conn)
+
+		return nil
+	})
+
 	for {
 		_, message, err := conn.ReadMessage()
 		if err != nil {
-			slog.Error("Error Reading Message. ", "error", err)
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				slog.Info("Connection Idle, closing.", "Remote", conn.RemoteAddr())
+				metrics.IdleDisconnects.Inc()
+			} else {
+				slog.Error("Error Reading Message. ", "error", err)
+			}
 
 			break
 		}
 
-		msgArgs := strings.Split(string(message), " ")
+		p.extendDeadline(conn)
+
+		if !quota.allowCommand() {
+			if p.reject(conn, quota, reasonRate, dtos.ErrCodeRateLimited, "too many commands") {
+				return
+			}
+
+			continue
+		}
+
+		msgArgs := strings.Fields(string(message))
+
+		slog.Debug("Message Received", "Message", string(message))
 
-		slog.Info("Message Received: ", "message", string(message))
+		if len(msgArgs) == 0 {
+			p.sendError(conn, dtos.ErrCodeBadRequest, "empty command")
+
+			continue
+		}
 
 		switch msgArgs[0] {
-		case subscribe:
-			currPair := msgArgs[1]
-			p.handleSubscription(conn, currPair)
-		case unsubscribe:
-			currPair := msgArgs[1]
-			p.handleUnsubscription(conn, currPair)
+		case subscribe, unsubscribe:
+			if len(msgArgs) < 2 {
+				p.sendError(conn, dtos.ErrCodeBadRequest, "currency pair is required")
+
+				continue
+			}
+
+			// the currency pairs are upper case, as in the REST paths
+			currPair := strings.ToUpper(msgArgs[1])
+
+			options, err := parseOptions(msgArgs[2:])
+			if err != nil {
+				p.sendError(conn, dtos.ErrCodeBadRequest, err.Error())
+
+				continue
+			}
+
+			if msgArgs[0] == unsubscribe {
+				p.handleUnsubscription(conn, currPair, options.Stream)
+				quota.unsubscribed(currPair, options.Stream)
+
+				continue
+			}
+
+			if options.Stream == "" {
+				options.Stream = subscriptions.StreamDepth
+			}
+
+			if !quota.allowSubscription(currPair, options.Stream) {
+				message := fmt.Sprintf("at most %d subscriptions per connection", p.limits.MaxSubscriptions)
+				if p.reject(conn, quota, reasonSubscriptions, dtos.ErrCodeLimitExceeded, message) {
+					return
+				}
+
+				continue
+			}
+
+			if p.handleSubscription(conn, identity, currPair, options) {
+				quota.subscribed(currPair, options.Stream)
+			}
+		case impact:
+			p.handleImpact(conn, identity, msgArgs[1:])
 		default:
 			slog.Info("Unknown command received")
 
-			if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
-				slog.Error("Error Writing Message: ", "error", err)
-			}
+			p.sendError(conn, dtos.ErrCodeUnknownCommand, "unknown command "+msgArgs[0])
 		}
 	}
 }
 
+// reject replies with an error to a command rejected by a limit. It reports whether the connection was closed
+// because of too many rejected commands.
+func (p *RequestProcessor) reject(conn *websocket.Conn, quota *commandQuota, reason, code, message string) bool {
+	slog.Info("Command Rejected", "Remote", conn.RemoteAddr(), "Reason", reason)
+	p.sendError(conn, code, message)
+
+	if !quota.violation(reason) {
+		return false
+	}
+
+	slog.Info("Closing Connection after too many rejected commands.", "Remote", conn.RemoteAddr())
+	metrics.ThrottledDisconnects.Inc()
+
+	closeMessage := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "too many rejected commands")
+	if err := conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(closeTimeout)); err != nil {
+		slog.Error("Error on Sending Close Message", "Error", err)
+	}
+
+	return true
+}
+
+// extendDeadline closes the connection if it stays idle for the idle timeout.
+func (p *RequestProcessor) extendDeadline(conn *websocket.Conn) {
+	if err := conn.SetReadDeadline(time.Now().Add(p.keepalive.IdleTimeout)); err != nil {
+		slog.Error("Error on Setting Read Deadline", "Error", err)
+	}
+}
+
 // handle user subscription request. add the currency subscription to the user and send the latest order book.
-func (p *RequestProcessor) handleSubscription(conn *websocket.Conn, currPair string) {
+// It reports whether the subscription was added.
+func (p *RequestProcessor) handleSubscription(conn *websocket.Conn, identity *auth.Identity, currPair string,
+	options subscriptions.Options) bool {
 	slog.Info("Order Book Subscription Requested", "currency pair", currPair)
-	p.subsManager.AddSubscription(currPair, conn)
+
+	// the configured symbols are served even while their processor waits for the upstream connection
+	if !slices.Contains(p.symbols, currPair) {
+		p.sendError(conn, dtos.ErrCodeUnknownSymbol, "unknown symbol "+currPair)
+
+		return false
+	}
+
+	if !identity.Entitlements.Allows(currPair, string(options.Stream)) {
+		slog.Info("Subscription Forbidden", "Subject", identity.Subject, "Currency", currPair, "Stream", options.Stream)
+		p.sendError(conn, dtos.ErrCodeForbidden, fmt.Sprintf("not entitled to the %s stream of %s", options.Stream, currPair))
+
+		return false
+	}
+
+	p.sendAck(conn, dtos.TypeSubscribed, currPair, options.Stream)
+	p.subsManager.AddSubscription(currPair, conn, options)
+
+	return true
 }
 
 // handle user unsubscription request. remove currency subscription from the user.
-func (p *RequestProcessor) handleUnsubscription(conn *websocket.Conn, currPair string) {
+func (p *RequestProcessor) handleUnsubscription(conn *websocket.Conn, currPair string, stream subscriptions.Stream) {
 	slog.Info("Order Book Unsubscription Requested", "curr pair", currPair)
-	p.subsManager.RemoveSubscription(currPair, conn)
+	p.subsManager.RemoveSubscription(currPair, conn, stream)
+	p.sendAck(conn, dtos.TypeUnsubscribed, currPair, stream)
+}
+
+// handle market impact request. estimate the fill of a market order and reply with an impact message.
+// IMPACT <currency pair> <buy|sell> <qty> [id=<request id>]. The estimate walks the book, so it needs the depth stream.
+func (p *RequestProcessor) handleImpact(conn *websocket.Conn, identity *auth.Identity, args []string) {
+	if len(args) < 3 {
+		p.sendError(conn, dtos.ErrCodeBadRequest, "usage: IMPACT <currency pair> <buy|sell> <qty> [id=<request id>]")
+
+		return
+	}
+
+	currPair := strings.ToUpper(args[0])
+
+	if !slices.Contains(p.symbols, currPair) {
+		p.sendError(conn, dtos.ErrCodeUnknownSymbol, "unknown symbol "+currPair)
+
+		return
+	}
+
+	if !identity.Entitlements.Allows(currPair, string(subscriptions.StreamDepth)) {
+		p.sendError(conn, dtos.ErrCodeForbidden, "not entitled to the depth stream of "+currPair)
+
+		return
+	}
+
+	side, qty, err := parseImpactRequest(args[1], args[2])
+	if err != nil {
+		p.sendError(conn, dtos.ErrCodeBadRequest, err.Error())
+
+		return
+	}
+
+	var id string
+
+	for _, arg := range args[3:] {
+		if key, value, _ := strings.Cut(arg, "="); key == idOption {
+			id = value
+		}
+	}
+
+	message, err := impactMessage(p.books, currPair, side, qty, id)
+	if err != nil {
+		err = bookError(err)
+		p.sendError(conn, bookErrorCode(err), err.Error())
+
+		return
+	}
+
+	p.subsManager.SendMessage(conn, message)
+}
+
+func (p *RequestProcessor) sendAck(conn *websocket.Conn, ackType dtos.MessageType, currPair string,
+	stream subscriptions.Stream) {
+	p.subsManager.SendMessage(conn, &dtos.Message{
+		Type:   ackType,
+		Symbol: currPair,
+		Ts:     time.Now().UnixMilli(),
+		Data:   dtos.SubscriptionAck{Symbol: currPair, Stream: string(stream)},
+	})
+}
+
+func (p *RequestProcessor) sendError(conn *websocket.Conn, code, message string) {
+	p.subsManager.SendMessage(conn, &dtos.Message{
+		Type: dtos.TypeError,
+		Ts:   time.Now().UnixMilli(),
+		Data: dtos.ErrorMessage{Code: code, Message: message},
+	})
+}
+
+// parseOptions parses the stream name and the key=value subscription options following the currency pair.
+func parseOptions(args []string) (subscriptions.Options, error) {
+	var options subscriptions.Options
+
+	for _, arg := range args {
+		key, value, found := strings.Cut(arg, "=")
+		if !found {
+			switch stream := subscriptions.Stream(arg); stream {
+			case subscriptions.StreamDepth, subscriptions.StreamBBO, subscriptions.StreamAnalytics:
+				options.Stream = stream
+			default:
+				return options, fmt.Errorf("unknown stream %s", arg)
+			}
+
+			continue
+		}
+
+		switch key {
+		case depthOption:
+			depth, err := strconv.Atoi(value)
+			if err != nil || depth < 1 || depth > maxDepth {
+				return options, fmt.Errorf("depth must be between 1 and %d", maxDepth)
+			}
+
+			options.Depth = depth
+		case groupOption:
+			group, err := strconv.ParseFloat(value, 64)
+			if err != nil || group <= 0 || math.IsNaN(group) || math.IsInf(group, 0) {
+				return options, fmt.Errorf("group must be a positive price step")
+			}
+
+			options.Group = group
+		case intervalOption:
+			interval, err := time.ParseDuration(value)
+			if err != nil || interval < minInterval || interval > maxInterval {
+				return options, fmt.Errorf("interval must be between %s and %s", minInterval, maxInterval)
+			}
+
+			options.Interval = interval
+		default:
+			return options, fmt.Errorf("unknown option %s", key)
+		}
+	}
+
+	if options.Stream != "" && options.Stream != subscriptions.StreamDepth && (options.Depth > 0 || options.Group > 0) {
+		return options, fmt.Errorf("depth and group are not supported by the %s stream", options.Stream)
+	}
+
+	return options, nil
 }
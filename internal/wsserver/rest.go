@@ -0,0 +1,222 @@
+package wsserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"ob-manager/internal/dtos"
+	"ob-manager/internal/processors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type AnalyticsGetter interface {
+	GetAnalytics(curr string) (*dtos.Message, error)
+}
+
+type OBGetter interface {
+	GetOrderBook(curr string, depth int) (*dtos.Snapshot, error)
+	GetBBO(curr string) (*dtos.BBO, int, error)
+}
+
+type ImpactGetter interface {
+	GetImpact(curr string, side dtos.Side, qty float64) (*dtos.Impact, int, error)
+}
+
+// BookGetter queries the order books maintained by the processors.
+type BookGetter interface {
+	OBGetter
+	StatusGetter
+	AnalyticsGetter
+	ImpactGetter
+}
+
+// RestHandler serves the order book data of the configured symbols over HTTP.
+type RestHandler struct {
+	books   BookGetter
+	symbols []string
+}
+
+// SymbolsResponse lists the currency pairs served.
+type SymbolsResponse struct {
+	Symbols []string `json:"symbols"`
+}
+
+// bookHandler returns the snapshot message of the order book, limited to the depth query parameter if set.
+func (h *RestHandler) bookHandler(w http.ResponseWriter, r *http.Request) {
+	symbol, ok := h.symbol(w, r)
+	if !ok {
+		return
+	}
+
+	var depth int
+
+	if depthArg := r.URL.Query().Get(depthOption); depthArg != "" {
+		var err error
+
+		depth, err = strconv.Atoi(depthArg)
+		if err != nil || depth < 1 || depth > maxDepth {
+			writeError(w, http.StatusBadRequest, dtos.ErrCodeBadRequest, fmt.Sprintf("depth must be between 1 and %d", maxDepth))
+
+			return
+		}
+	}
+
+	snapshot, err := h.books.GetOrderBook(symbol, depth)
+	if err != nil {
+		writeBookError(w, err)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &dtos.Message{
+		Type:   dtos.TypeSnapshot,
+		Symbol: symbol,
+		Seq:    snapshot.LastUpdateId,
+		Ts:     time.Now().UnixMilli(),
+		Data:   snapshot,
+	})
+}
+
+// bboHandler returns the bbo message of the order book.
+func (h *RestHandler) bboHandler(w http.ResponseWriter, r *http.Request) {
+	symbol, ok := h.symbol(w, r)
+	if !ok {
+		return
+	}
+
+	bbo, lastUpdateId, err := h.books.GetBBO(symbol)
+	if err != nil {
+		writeBookError(w, err)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &dtos.Message{
+		Type:   dtos.TypeBBO,
+		Symbol: symbol,
+		Seq:    lastUpdateId,
+		Ts:     time.Now().UnixMilli(),
+		Data:   bbo,
+	})
+}
+
+// symbolsHandler returns the currency pairs served.
+func (h *RestHandler) symbolsHandler(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, SymbolsResponse{Symbols: h.symbols})
+}
+
+// symbol returns the upper case currency pair of the path. A currency pair that is not configured gets a 404.
+func (h *RestHandler) symbol(w http.ResponseWriter, r *http.Request) (string, bool) {
+	symbol := strings.ToUpper(r.PathValue("symbol"))
+	if !slices.Contains(h.symbols, symbol) {
+		writeError(w, http.StatusNotFound, dtos.ErrCodeUnknownSymbol, "unknown symbol "+symbol)
+
+		return "", false
+	}
+
+	return symbol, true
+}
+
+// analyticsHandler returns the latest analytics of a currency pair.
+func (h *RestHandler) analyticsHandler(w http.ResponseWriter, r *http.Request) {
+	symbol, ok := h.symbol(w, r)
+	if !ok {
+		return
+	}
+
+	analytics, err := h.books.GetAnalytics(symbol)
+	if err != nil {
+		writeBookError(w, err)
+
+		return
+	}
+
+	if analytics == nil {
+		writeError(w, http.StatusServiceUnavailable, dtos.ErrCodeNotSynced, "order book is not synced")
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, analytics)
+}
+
+// impactHandler returns the estimated fill of a market order of the side and qty query parameters.
+func (h *RestHandler) impactHandler(w http.ResponseWriter, r *http.Request) {
+	symbol, ok := h.symbol(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+
+	side, qty, err := parseImpactRequest(query.Get("side"), query.Get("qty"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, dtos.ErrCodeBadRequest, err.Error())
+
+		return
+	}
+
+	message, err := impactMessage(h.books, symbol, side, qty, query.Get("id"))
+	if err != nil {
+		writeBookError(w, err)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, message)
+}
+
+// writeBookError maps the order book errors of a configured symbol to the HTTP status codes.
+func writeBookError(w http.ResponseWriter, err error) {
+	err = bookError(err)
+	status := http.StatusInternalServerError
+
+	switch {
+	case errors.Is(err, processors.ErrUnknownSymbol):
+		status = http.StatusNotFound
+	case errors.Is(err, processors.ErrNotSynced):
+		status = http.StatusServiceUnavailable
+	}
+
+	writeError(w, status, bookErrorCode(err), err.Error())
+}
+
+// bookError returns the error of the order book of a configured symbol. A configured symbol without a processor
+// is not synced: the processors are started once the upstream is connected and reset when it reconnects.
+func bookError(err error) error {
+	if errors.Is(err, processors.ErrUnknownSymbol) {
+		return processors.ErrNotSynced
+	}
+
+	return err
+}
+
+// bookErrorCode maps the order book errors to the protocol error codes.
+func bookErrorCode(err error) string {
+	switch {
+	case errors.Is(err, processors.ErrUnknownSymbol):
+		return dtos.ErrCodeUnknownSymbol
+	case errors.Is(err, processors.ErrNotSynced):
+		return dtos.ErrCodeNotSynced
+	default:
+		return dtos.ErrCodeInternal
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, dtos.ErrorMessage{Code: code, Message: message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		slog.Error("Error on Writing Response", "Error", err)
+	}
+}
@@ -2,66 +2,277 @@ package wsserver
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"ob-manager/internal/auth"
+	"ob-manager/internal/config"
+	"ob-manager/internal/dtos"
+	"ob-manager/internal/encoding"
 	"ob-manager/internal/subscriptions"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const (
 	subscribe, unsubscribe = "SUB", "UNSUB"
+	impact                 = "IMPACT"
+	idOption               = "id"
+	depthOption            = "depth"
+	maxDepth               = 1000
+	groupOption            = "group"
+	intervalOption         = "interval"
+	minInterval            = 50 * time.Millisecond
+	maxInterval            = time.Minute
+	encodingParam          = "encoding"
+	// shutdownTimeout is the maximum time to complete the HTTP requests in flight when the server stops.
+	shutdownTimeout = 30 * time.Second
 )
 
 type WSServer struct {
-	srv       *http.Server
-	processor *RequestProcessor
+	srv         *http.Server
+	processor   *RequestProcessor
+	rest        *RestHandler
+	health      *HealthHandler
+	upgrader    websocket.Upgrader
+	compression config.Compression
+	auth        auth.Authenticator
+	conns       *connLimiter
 }
 
-func NewWSServer(subs *subscriptions.Manager) *WSServer {
+// NewWSServer creates the downstream server, listening when Run is called.
+// The server terminates TLS with tlsConfig when it is not nil.
+func NewWSServer(cfg *config.Config, subs *subscriptions.Manager, books BookGetter, upstream UpstreamState,
+	authenticator auth.Authenticator, tlsConfig *tls.Config) *WSServer {
 	proc := &RequestProcessor{
 		subsManager: subs,
+		books:       books,
+		symbols:     cfg.Symbols,
+		keepalive:   cfg.Keepalive,
+		limits:      cfg.Limits,
 	}
+	rest := &RestHandler{
+		books:   books,
+		symbols: cfg.Symbols,
+	}
+	health := &HealthHandler{
+		upstream: upstream,
+		books:    books,
+		subs:     subs,
+		symbols:  cfg.Symbols,
+	}
+	mux := http.NewServeMux()
 	server := &http.Server{
-		Addr:    ":8080",
-		Handler: nil,
+		Addr:      cfg.Addr,
+		Handler:   mux,
+		TLSConfig: tlsConfig,
 	}
 
 	s := &WSServer{
 		srv:       server,
 		processor: proc,
+		rest:      rest,
+		health:    health,
+		upgrader: websocket.Upgrader{
+			CheckOrigin:       checkOrigin(cfg.Auth.AllowedOrigins),
+			Subprotocols:      encoding.Subprotocols(),
+			EnableCompression: cfg.Compression.Enabled,
+		},
+		compression: cfg.Compression,
+		auth:        authenticator,
+		conns:       newConnLimiter(cfg.Limits),
 	}
 
-	go s.startServer()
+	s.routes(mux)
 
 	return s
 }
 
-func (s *WSServer) ShutDown(ctx context.Context) error {
-	return s.srv.Shutdown(ctx)
+// routes registers the websocket, REST, health and metrics endpoints of the server.
+// The REST and metrics endpoints authenticate the clients like the websocket, the health endpoints are open
+// to the probes.
+func (s *WSServer) routes(mux *http.ServeMux) {
+	mux.HandleFunc("/ws", s.websocketHandler)
+	mux.Handle("GET /metrics", s.authorize("", promhttp.Handler()))
+	mux.HandleFunc("GET /healthz", s.health.healthzHandler)
+	mux.HandleFunc("GET /readyz", s.health.readyzHandler)
+	mux.HandleFunc("GET /status", s.health.statusHandler)
+	mux.Handle("GET /api/v1/symbols", s.authorize("", http.HandlerFunc(s.rest.symbolsHandler)))
+	mux.Handle("GET /api/v1/books/{symbol}", s.authorize(subscriptions.StreamDepth, http.HandlerFunc(s.rest.bookHandler)))
+	mux.Handle("GET /api/v1/books/{symbol}/bbo", s.authorize(subscriptions.StreamBBO, http.HandlerFunc(s.rest.bboHandler)))
+	mux.Handle("GET /api/v1/analytics/{symbol}",
+		s.authorize(subscriptions.StreamAnalytics, http.HandlerFunc(s.rest.analyticsHandler)))
+	// the estimate walks the book, so it needs the depth stream as the IMPACT command
+	mux.Handle("GET /api/v1/books/{symbol}/impact",
+		s.authorize(subscriptions.StreamDepth, http.HandlerFunc(s.rest.impactHandler)))
 }
 
-func (s *WSServer) startServer() {
-	http.HandleFunc("/ws", s.websocketHandler)
-	slog.Info("Websocket Server started on :8080")
+// authorize serves the requests of the authenticated clients entitled to the stream of the currency pair of the
+// path. An empty stream only authenticates the client. The other clients get a 401 or 403 error message.
+func (s *WSServer) authorize(stream subscriptions.Stream, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := s.authenticate(w, r)
+		if !ok {
+			return
+		}
+
+		if symbol := strings.ToUpper(r.PathValue("symbol")); stream != "" &&
+			!identity.Entitlements.Allows(symbol, string(stream)) {
+			slog.Info("Request Forbidden", "Subject", identity.Subject, "Currency", symbol, "Stream", stream)
+			writeError(w, http.StatusForbidden, dtos.ErrCodeForbidden,
+				fmt.Sprintf("not entitled to the %s stream of %s", stream, symbol))
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
 
-	err := s.srv.ListenAndServe()
+// authenticate returns the identity of the client of the request. The clients failing the authentication get
+// a 401 error message.
+func (s *WSServer) authenticate(w http.ResponseWriter, r *http.Request) (*auth.Identity, bool) {
+	identity, err := s.auth.Authenticate(r)
 	if err != nil {
-		slog.Error("Error on websocket Server: ", "Error", err)
+		slog.Info("Authentication Failed", "Remote", r.RemoteAddr, "Path", r.URL.Path, "Error", err)
+
+		// the details of the failure are only logged
+		reason := auth.ErrInvalidCredentials
+		if errors.Is(err, auth.ErrMissingCredentials) {
+			reason = auth.ErrMissingCredentials
+		}
+
+		writeError(w, http.StatusUnauthorized, dtos.ErrCodeUnauthorized, reason.Error())
+
+		return nil, false
 	}
+
+	return identity, true
+}
+
+// Handler returns the handler of the endpoints of the server, e.g. to serve them on another listener.
+func (s *WSServer) Handler() http.Handler {
+	return s.srv.Handler
+}
+
+// Run serves the downstream clients until the context is done, then stops accepting connections.
+// The websocket connections are not closed: they are hijacked from the HTTP server.
+func (s *WSServer) Run(ctx context.Context) error {
+	slog.Info("Websocket Server started", "Addr", s.srv.Addr, "TLS", s.srv.TLSConfig != nil)
+
+	errs := make(chan error, 1)
+
+	go func() {
+		// the certificates are served by the TLS config
+		if s.srv.TLSConfig != nil {
+			errs <- s.srv.ListenAndServeTLS("", "")
+		} else {
+			errs <- s.srv.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownTimeout)
+	defer cancel()
+
+	if err := s.srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("closing: %w", err)
+	}
+
+	<-errs
+	slog.Info("Websocket Server stopped")
+
+	return nil
 }
 
+// websocketHandler authenticates the client and upgrades the connection with the encoding asked by
+// the ?encoding= query parameter or negotiated with the obm.<encoding>.v1 subprotocols.
+// The messages are JSON by default. The clients failing the authentication get a 401 error message and the clients
+// over their connection quota a 429 error message.
 func (s *WSServer) websocketHandler(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	identity, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	enc := encoding.JSON
+
+	if name := r.URL.Query().Get(encodingParam); name != "" {
+		var err error
+
+		if enc, err = encoding.Parse(name); err != nil {
+			writeError(w, http.StatusBadRequest, dtos.ErrCodeBadRequest, err.Error())
+
+			return
+		}
+	}
+
+	ip := remoteIP(r)
+
+	if reason, ok := s.conns.acquire(ip, identity); !ok {
+		slog.Info("Websocket Connection Rejected", "Remote", r.RemoteAddr, "Subject", identity.Subject, "Reason", reason)
+		writeError(w, http.StatusTooManyRequests, dtos.ErrCodeLimitExceeded, "too many connections per "+reason)
+
+		return
+	}
+
+	mw := &meteredWriter{ResponseWriter: w}
+
+	conn, err := s.upgrader.Upgrade(mw, r, nil)
 	if err != nil {
 		slog.Error("Error Upgrading Websocket: ", "Error", err)
+		s.conns.release(ip, identity)
 
 		return
 	}
 
-	go s.processor.handleConnection(conn)
+	if negotiated, ok := encoding.FromSubprotocol(conn.Subprotocol()); ok && r.URL.Query().Get(encodingParam) == "" {
+		enc = negotiated
+	}
+
+	// the level applies only if the client negotiated the compression
+	if err := conn.SetCompressionLevel(s.compression.Level); err != nil {
+		slog.Error("Error Setting Compression Level", "Error", err)
+	}
+
+	s.processor.subsManager.AddUser(conn, subscriptions.ConnOptions{
+		Encoding:             enc,
+		CompressionThreshold: s.compression.Threshold,
+		WireBytes:            mw.conn.Written,
+		PingInterval:         s.processor.keepalive.PingInterval,
+	})
+
+	slog.Info("Websocket Connected", "Remote", r.RemoteAddr, "Subject", identity.Subject, "Encoding", enc)
+
+	go func() {
+		defer s.conns.release(ip, identity)
+
+		s.processor.handleConnection(conn, identity)
+	}()
 }
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
+// checkOrigin allows the browsers of the allowed origins. The clients sending no Origin header are not browsers
+// and are allowed. An empty list allows all the origins.
+func checkOrigin(allowed []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if len(allowed) == 0 || origin == "" {
+			return true
+		}
+
+		return slices.ContainsFunc(allowed, func(o string) bool {
+			return strings.EqualFold(o, origin)
+		})
+	}
 }
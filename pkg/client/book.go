@@ -0,0 +1,221 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"ob-manager/internal/feed"
+	"ob-manager/pkg/protocol"
+
+	tree "github.com/emirpasic/gods/trees/redblacktree"
+)
+
+// Level is a price level of the order book.
+type Level struct {
+	Price float64
+	Qty   float64
+}
+
+// Book is the local order book of a depth subscription, rebuilt from the snapshot and the deltas of the server.
+// It is safe to read while the client updates it.
+type Book struct {
+	symbol string
+
+	mu           sync.RWMutex
+	bids         *tree.Tree
+	asks         *tree.Tree
+	lastUpdateId int
+	synced       bool
+	state        protocol.BookState
+}
+
+func newBook(symbol string) *Book {
+	return &Book{
+		symbol: symbol,
+		bids:   feed.NewBids(),
+		asks:   feed.NewAsks(),
+	}
+}
+
+// Symbol returns the currency pair of the order book.
+func (b *Book) Symbol() string {
+	return b.symbol
+}
+
+// LastUpdateId returns the last update id applied to the order book.
+func (b *Book) LastUpdateId() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.lastUpdateId
+}
+
+// Synced reports whether the order book has a snapshot and all the deltas following it. It is not synced
+// after a resync or a sequence gap until the next snapshot.
+func (b *Book) Synced() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.synced
+}
+
+// State returns the last state of the book published by the server. It is empty until the first status message.
+func (b *Book) State() protocol.BookState {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.state
+}
+
+// Bids returns the best depth bids, from the highest price. A depth of 0 returns all the bids.
+func (b *Book) Bids(depth int) []Level {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return feed.TopLevels(b.bids, depth, newLevel)
+}
+
+// Asks returns the best depth asks, from the lowest price. A depth of 0 returns all the asks.
+func (b *Book) Asks(depth int) []Level {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return feed.TopLevels(b.asks, depth, newLevel)
+}
+
+// BBO returns the best bid and ask. ok is false when a side of the book is empty.
+func (b *Book) BBO() (bid, ask Level, ok bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	bestBid, bestAsk := b.bids.Left(), b.asks.Left()
+	if bestBid == nil || bestAsk == nil {
+		return bid, ask, false
+	}
+
+	bid = newLevel(bestBid.Key.(float64), bestBid.Value.(float64))
+	ask = newLevel(bestAsk.Key.(float64), bestAsk.Value.(float64))
+
+	return bid, ask, true
+}
+
+// reset replaces the order book with a snapshot.
+func (b *Book) reset(snapshot *protocol.Snapshot) error {
+	bids, err := parseLevels(snapshot.Bids)
+	if err != nil {
+		return err
+	}
+
+	asks, err := parseLevels(snapshot.Asks)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.bids.Clear()
+	b.asks.Clear()
+	putLevels(b.bids, bids)
+	putLevels(b.asks, asks)
+
+	b.lastUpdateId = snapshot.LastUpdateId
+	b.synced = true
+
+	return nil
+}
+
+// invalidate clears the order book until the next snapshot.
+func (b *Book) invalidate() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.bids.Clear()
+	b.asks.Clear()
+	b.synced = false
+}
+
+func (b *Book) setState(state protocol.BookState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = state
+}
+
+// errSequenceGap is returned by apply when a delta does not follow the order book.
+var errSequenceGap = errors.New("sequence gap")
+
+// apply applies a delta following the order book. The delta must cover the update following the last update id
+// of the order book and prevSeq, the sequence of the previous message of the stream, must not be after it.
+// The deltas merged by the server may overlap the order book, as the levels carry the latest quantities.
+// It reports whether the delta was applied: the deltas preceding the snapshot and the deltas received while the
+// book is not synced are skipped.
+func (b *Book) apply(prevSeq int, delta *protocol.Delta) (bool, error) {
+	bids, err := parseLevels(delta.Bids)
+	if err != nil {
+		return false, err
+	}
+
+	asks, err := parseLevels(delta.Asks)
+	if err != nil {
+		return false, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.synced || delta.FinalUpdateId <= b.lastUpdateId {
+		return false, nil
+	}
+
+	if prevSeq > b.lastUpdateId || delta.FirstUpdateId > b.lastUpdateId+1 {
+		b.synced = false
+
+		return false, fmt.Errorf("%w: last update id %d, delta from %d to %d", errSequenceGap, b.lastUpdateId,
+			delta.FirstUpdateId, delta.FinalUpdateId)
+	}
+
+	putLevels(b.bids, bids)
+	putLevels(b.asks, asks)
+
+	b.lastUpdateId = delta.FinalUpdateId
+
+	return true, nil
+}
+
+func parseLevels(levels [][]string) ([]Level, error) {
+	parsed := make([]Level, 0, len(levels))
+
+	for _, level := range levels {
+		if len(level) != 2 {
+			return nil, fmt.Errorf("invalid price level %v", level)
+		}
+
+		price, err := strconv.ParseFloat(level[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid price %s: %w", level[0], err)
+		}
+
+		qty, err := strconv.ParseFloat(level[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quantity %s: %w", level[1], err)
+		}
+
+		parsed = append(parsed, Level{Price: price, Qty: qty})
+	}
+
+	return parsed, nil
+}
+
+// putLevels updates the price levels of a side. A zero quantity removes the level.
+func putLevels(side *tree.Tree, levels []Level) {
+	for _, level := range levels {
+		feed.PutLevel(side, level.Price, level.Qty)
+	}
+}
+
+func newLevel(price, qty float64) Level {
+	return Level{Price: price, Qty: qty}
+}
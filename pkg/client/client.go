@@ -0,0 +1,359 @@
+// Package client connects to the OBManager websocket server, keeps the subscriptions across the reconnections and
+// maintains local order books from the depth streams.
+//
+//	c, err := client.New(client.Config{URL: "ws://localhost:8080/ws"})
+//	if err != nil {
+//		return err
+//	}
+//
+//	sub, err := c.Subscribe("BTCUSDT", client.StreamDepth, client.Options{})
+//	go c.Run(ctx)
+//
+//	for update := range sub.C() {
+//		bid, ask, _ := update.Book.BBO()
+//		...
+//	}
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ob-manager/pkg/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// readTimeout closes a connection that received no message nor ping, the server pinging more often.
+	readTimeout = 60 * time.Second
+	// writeTimeout is the maximum time to write a command or the close message.
+	writeTimeout = 10 * time.Second
+	// subprotocol of the JSON encoding decoded by the protocol package.
+	subprotocol = "obm.json.v1"
+)
+
+var (
+	// ErrRejected is returned by Run when the server rejects the credentials of the client.
+	ErrRejected = errors.New("connection rejected")
+	// ErrClosed is returned when the client is stopped.
+	ErrClosed = errors.New("client closed")
+)
+
+// Config of the client. The zero values are replaced by the defaults.
+type Config struct {
+	// URL of the websocket endpoint, e.g. ws://localhost:8080/ws.
+	URL string
+	// APIKey is sent in the X-API-Key header of the apikey authentication mode.
+	APIKey string
+	// Token is sent as a bearer token of the hmac and jwt authentication modes.
+	Token string
+	// TLSConfig of the wss connections, with the client certificate of the mtls authentication mode.
+	TLSConfig *tls.Config
+	// MinBackoff is the delay before reconnecting, doubled after each failed attempt up to MaxBackoff.
+	// They default to 1s and 60s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Buffer is the number of updates buffered for each channel subscription. It defaults to 1024.
+	Buffer int
+	// OnError is called with the error messages of the server, e.g. a forbidden subscription.
+	// The errors are logged by default.
+	OnError func(*protocol.ErrorMessage)
+}
+
+func (c Config) withDefaults() (Config, error) {
+	if c.URL == "" {
+		return c, fmt.Errorf("server URL is required")
+	}
+
+	if c.MinBackoff <= 0 {
+		c.MinBackoff = time.Second
+	}
+
+	if c.MaxBackoff < c.MinBackoff {
+		c.MaxBackoff = max(60*time.Second, c.MinBackoff)
+	}
+
+	if c.Buffer <= 0 {
+		c.Buffer = 1024
+	}
+
+	if c.OnError == nil {
+		c.OnError = func(message *protocol.ErrorMessage) {
+			slog.Error("Error Message Received", "Code", message.Code, "Message", message.Message)
+		}
+	}
+
+	return c, nil
+}
+
+// Client of the websocket server. The subscriptions are sent when connected and again after each reconnection.
+type Client struct {
+	cfg    Config
+	dialer *websocket.Dialer
+	header http.Header
+
+	connected atomic.Bool
+
+	// mu guards the subscriptions and the writes of the commands to the connection.
+	mu      sync.Mutex
+	conn    *websocket.Conn
+	subs    map[subscriptionKey]*Subscription
+	stopped bool
+}
+
+// New creates the client of the server. It connects when Run is called.
+func New(cfg Config) (*Client, error) {
+	cfg, err := cfg.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	header := make(http.Header)
+
+	if cfg.APIKey != "" {
+		header.Set("X-API-Key", cfg.APIKey)
+	}
+
+	if cfg.Token != "" {
+		header.Set("Authorization", "Bearer "+cfg.Token)
+	}
+
+	return &Client{
+		cfg: cfg,
+		dialer: &websocket.Dialer{
+			Proxy:            http.ProxyFromEnvironment,
+			HandshakeTimeout: websocket.DefaultDialer.HandshakeTimeout,
+			TLSClientConfig:  cfg.TLSConfig,
+			Subprotocols:     []string{subprotocol},
+		},
+		header: header,
+		subs:   make(map[subscriptionKey]*Subscription),
+	}, nil
+}
+
+// Run connects to the server and delivers its messages to the subscriptions until the context is done,
+// reconnecting when the connection fails. The subscriptions are then closed with ErrClosed. Run returns an error
+// wrapping ErrRejected when the server rejects the credentials, as retrying would fail the same way.
+func (c *Client) Run(ctx context.Context) error {
+	defer c.stop()
+
+	waitTime := c.cfg.MinBackoff
+
+	for {
+		connected, err := c.session(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if errors.Is(err, ErrRejected) {
+			return err
+		}
+
+		if connected {
+			waitTime = c.cfg.MinBackoff
+		}
+
+		slog.Error("Connection to the Server Lost, reconnecting.", "Error", err, "Wait", waitTime)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(waitTime):
+			waitTime = min(waitTime*2, c.cfg.MaxBackoff)
+		}
+	}
+}
+
+// Connected reports whether the connection with the server is up.
+func (c *Client) Connected() bool {
+	return c.connected.Load()
+}
+
+// session connects to the server, sends the subscriptions and reads the messages until the connection fails or the
+// context is done. It reports whether the connection was established.
+func (c *Client) session(ctx context.Context) (bool, error) {
+	conn, resp, err := c.dialer.DialContext(ctx, c.cfg.URL, c.header)
+	if err != nil {
+		if resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+			return false, fmt.Errorf("%w: %s", ErrRejected, resp.Status)
+		}
+
+		return false, err
+	}
+
+	slog.Info("Connected to the Server", "url", c.cfg.URL)
+
+	// the reader returns on the expired deadline, then the connection is closed
+	stop := context.AfterFunc(ctx, func() {
+		closeMessage := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+		if err := conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(writeTimeout)); err != nil {
+			slog.Error("Error on Sending Close Message", "Error", err)
+		}
+
+		if err := conn.SetReadDeadline(time.Now()); err != nil {
+			slog.Error("Error on Setting Read Deadline", "Error", err)
+		}
+	})
+	defer stop()
+
+	c.setConnection(conn)
+	defer c.clearConnection(conn)
+
+	return true, c.readMessages(conn)
+}
+
+// setConnection keeps the connection for the commands and sends the subscriptions.
+func (c *Client) setConnection(conn *websocket.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.conn = conn
+	c.connected.Store(true)
+
+	for _, s := range c.subs {
+		c.sendCommand(s.command(subscribe))
+	}
+}
+
+// clearConnection closes the connection. The local books are invalid until the snapshots of the next connection,
+// so the depth subscriptions get a resync message.
+func (c *Client) clearConnection(conn *websocket.Conn) {
+	c.mu.Lock()
+	c.conn = nil
+	c.connected.Store(false)
+
+	var books []*Subscription
+
+	for _, s := range c.subs {
+		if s.book != nil {
+			books = append(books, s)
+		}
+	}
+	c.mu.Unlock()
+
+	if err := conn.Close(); err != nil {
+		slog.Error("Error on Closing the Connection", "Error", err)
+	}
+
+	for _, s := range books {
+		s.book.invalidate()
+		s.deliver(resyncUpdate(s.key.symbol, "connection lost"))
+	}
+}
+
+// stop closes the subscriptions once Run returns.
+func (c *Client) stop() {
+	c.mu.Lock()
+	c.stopped = true
+	subs := c.subs
+	c.subs = make(map[subscriptionKey]*Subscription)
+	c.mu.Unlock()
+
+	for _, s := range subs {
+		s.sink.Close(ErrClosed)
+	}
+}
+
+// sendCommand writes a command to the connection. It is called with the lock held and does nothing while
+// disconnected, as the subscriptions are sent on the next connection.
+func (c *Client) sendCommand(command string) {
+	if c.conn == nil {
+		return
+	}
+
+	if err := c.conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		slog.Error("Error on Setting Write Deadline", "Error", err)
+	}
+
+	// a failed write fails the reader, which reconnects
+	if err := c.conn.WriteMessage(websocket.TextMessage, []byte(command)); err != nil {
+		slog.Error("Error on Sending Command", "Command", command, "Error", err)
+	}
+}
+
+// readMessages delivers the messages of the connection to the subscriptions until the connection fails.
+func (c *Client) readMessages(conn *websocket.Conn) error {
+	extendDeadline := func() {
+		if err := conn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+			slog.Error("Error on Setting Read Deadline", "Error", err)
+		}
+	}
+
+	extendDeadline()
+
+	conn.SetPingHandler(func(data string) error {
+		extendDeadline()
+
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(writeTimeout))
+		if errors.Is(err, websocket.ErrCloseSent) {
+			return nil
+		}
+
+		return err
+	})
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		extendDeadline()
+
+		envelope, err := protocol.Decode(message)
+		if err != nil {
+			slog.Error("Error on Decoding Message", "Error", err)
+
+			continue
+		}
+
+		c.handleMessage(envelope)
+	}
+}
+
+// handleMessage delivers a message to the subscriptions of its currency pair.
+func (c *Client) handleMessage(envelope *protocol.Envelope) {
+	switch envelope.Type {
+	case protocol.TypeHeartbeat, protocol.TypeSubscribed, protocol.TypeUnsubscribed, protocol.TypeImpact:
+		return
+	case protocol.TypeError:
+		message, err := envelope.Error()
+		if err != nil {
+			slog.Error("Error on Decoding Message", "Error", err)
+
+			return
+		}
+
+		c.cfg.OnError(message)
+
+		return
+	}
+
+	for _, s := range c.subscriptions(envelope.Symbol) {
+		s.handle(envelope)
+	}
+}
+
+// subscriptions returns the subscriptions to the currency pair.
+func (c *Client) subscriptions(symbol string) []*Subscription {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var subs []*Subscription
+
+	for key, s := range c.subs {
+		if key.symbol == symbol {
+			subs = append(subs, s)
+		}
+	}
+
+	return subs
+}
@@ -0,0 +1,438 @@
+package client_test
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"log/slog"
+	"maps"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"ob-manager/internal/auth"
+	"ob-manager/internal/config"
+	"ob-manager/internal/dtos"
+	"ob-manager/internal/queues"
+	outqueues "ob-manager/internal/queues/out"
+	"ob-manager/internal/subscriptions"
+	"ob-manager/internal/wsserver"
+	"ob-manager/pkg/client"
+	"ob-manager/pkg/protocol"
+)
+
+const (
+	testSymbol = "BTCUSDT"
+	// waitTimeout bounds the wait for each expected update.
+	waitTimeout = 5 * time.Second
+	// publishInterval spaces the deltas published while waiting for a snapshot.
+	publishInterval = 10 * time.Millisecond
+)
+
+var errNotServed = errors.New("not served by the test book")
+
+func TestMain(m *testing.M) {
+	// the connections and subscriptions are logged one by one
+	slog.SetDefault(slog.New(slog.DiscardHandler))
+
+	os.Exit(m.Run())
+}
+
+func TestSnapshotAndDelta(t *testing.T) {
+	srv := startServer(t)
+	sub := subscribe(t, srv)
+
+	srv.sync(t, sub)
+
+	seq := srv.publish(map[string]string{"65000": "3", "64998": "1"}, map[string]string{"65001": "0", "65003": "2"})
+
+	update := next(t, sub, protocol.TypeDelta)
+	if update.Seq != seq || update.PrevSeq != seq-1 {
+		t.Errorf("delta seq = %d, prevSeq = %d, want %d, %d", update.Seq, update.PrevSeq, seq, seq-1)
+	}
+
+	srv.assertBook(t, update.Book)
+}
+
+func TestSequenceGap(t *testing.T) {
+	srv := startServer(t)
+	sub := subscribe(t, srv)
+
+	srv.sync(t, sub)
+
+	// the delta is lost, so the next one does not follow the local book
+	srv.lose(map[string]string{"64999": "4"}, nil)
+	srv.publish(nil, map[string]string{"65002": "5"})
+
+	assertResync(t, next(t, sub, protocol.TypeResync), "sequence gap")
+
+	if sub.Book().Synced() {
+		t.Error("book synced after the sequence gap")
+	}
+
+	// the book is synced again by the snapshot sent after the resubscription
+	srv.sync(t, sub)
+	srv.publish(map[string]string{"65000": "0"}, nil)
+	srv.assertBook(t, next(t, sub, protocol.TypeDelta).Book)
+}
+
+func TestResubscribeAfterDisconnect(t *testing.T) {
+	srv := startServer(t)
+	sub := subscribe(t, srv)
+
+	srv.sync(t, sub)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if users, _ := srv.subs.Drain(ctx); users != 1 {
+		t.Fatalf("drained %d users, want 1", users)
+	}
+
+	assertResync(t, next(t, sub, protocol.TypeResync), "connection lost")
+
+	// the client reconnects and resubscribes, then the book is synced by the new snapshot
+	srv.lose(map[string]string{"64997": "2"}, nil)
+	srv.sync(t, sub)
+
+	if !srv.client.Connected() {
+		t.Error("client not connected after the snapshot")
+	}
+
+	srv.publish(nil, map[string]string{"65004": "1"})
+	srv.assertBook(t, next(t, sub, protocol.TypeDelta).Book)
+}
+
+// testServer is a websocket server of an order book updated by the test, and a client connected to it.
+type testServer struct {
+	book   *fakeBook
+	outQ   *outqueues.Queue
+	subs   *subscriptions.Manager
+	client *client.Client
+}
+
+// startServer starts the websocket server on a test listener and runs a client connected to it. Both are
+// stopped at the end of the test.
+func startServer(t *testing.T) *testServer {
+	t.Helper()
+
+	t.Setenv("OBM_SYMBOLS", testSymbol)
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authenticator, err := auth.New(cfg.Auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	book := newFakeBook()
+	outQ := outqueues.NewQueue(queues.Settings{Size: 1024, Policy: queues.Block}, 1)
+	subs := subscriptions.NewManager(outQ, book, 1024)
+	ws := wsserver.NewWSServer(cfg, subs, book, upstream{}, authenticator, nil)
+
+	ts := httptest.NewServer(ws.Handler())
+
+	c, err := client.New(client.Config{
+		URL:        "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws",
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var wg sync.WaitGroup
+
+	wg.Go(func() { _ = outQ.Run(ctx) })
+	wg.Go(func() { _ = subs.Run(ctx) })
+	wg.Go(func() { _ = c.Run(ctx) })
+
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+		ts.Close()
+	})
+
+	return &testServer{book: book, outQ: outQ, subs: subs, client: c}
+}
+
+// subscribe subscribes the client to the depth stream of the test symbol.
+func subscribe(t *testing.T, srv *testServer) *client.Subscription {
+	t.Helper()
+
+	sub, err := srv.client.Subscribe(testSymbol, client.StreamDepth, client.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sub
+}
+
+// publish applies a delta to the book and sends it to the subscribers, as a processor does. It returns the
+// sequence of the delta.
+func (s *testServer) publish(bids, asks map[string]string) int {
+	message := s.book.apply(bids, asks)
+	s.outQ.AddToOutQ(message)
+
+	return message.Seq
+}
+
+// lose applies a delta to the book without sending it.
+func (s *testServer) lose(bids, asks map[string]string) {
+	s.book.apply(bids, asks)
+}
+
+// sync publishes deltas until the subscription gets a snapshot: the server sends the snapshot of a new
+// subscription with the next delta. The deltas received meanwhile are skipped by the unsynced book.
+func (s *testServer) sync(t *testing.T, sub *client.Subscription) {
+	t.Helper()
+
+	deadline := time.After(waitTimeout)
+	ticker := time.NewTicker(publishInterval)
+	defer ticker.Stop()
+
+	for i := 0; ; i++ {
+		select {
+		case update, ok := <-sub.C():
+			if !ok {
+				t.Fatalf("subscription closed: %v", sub.Err())
+			}
+
+			if update.Type == protocol.TypeSnapshot {
+				s.assertBook(t, update.Book)
+
+				return
+			}
+		case <-ticker.C:
+			s.publish(map[string]string{strconv.Itoa(64900 - i): "1"}, nil)
+		case <-deadline:
+			t.Fatal("no snapshot received")
+		}
+	}
+}
+
+// assertBook checks that the local book has the levels and the last update id of the server book.
+func (s *testServer) assertBook(t *testing.T, book *client.Book) {
+	t.Helper()
+
+	want := s.book.snapshot()
+
+	if !book.Synced() {
+		t.Error("book not synced")
+	}
+
+	if got := book.LastUpdateId(); got != want.LastUpdateId {
+		t.Errorf("LastUpdateId() = %d, want %d", got, want.LastUpdateId)
+	}
+
+	if got, want := book.Bids(0), levels(t, want.Bids); !slices.Equal(got, want) {
+		t.Errorf("Bids() = %v, want %v", got, want)
+	}
+
+	if got, want := book.Asks(0), levels(t, want.Asks); !slices.Equal(got, want) {
+		t.Errorf("Asks() = %v, want %v", got, want)
+	}
+}
+
+// next returns the next update of the given type, skipping the others.
+func next(t *testing.T, sub *client.Subscription, messageType protocol.MessageType) client.Update {
+	t.Helper()
+
+	deadline := time.After(waitTimeout)
+
+	for {
+		select {
+		case update, ok := <-sub.C():
+			if !ok {
+				t.Fatalf("subscription closed: %v", sub.Err())
+			}
+
+			if update.Type == messageType {
+				return update
+			}
+		case <-deadline:
+			t.Fatalf("no %s message received", messageType)
+		}
+	}
+}
+
+func assertResync(t *testing.T, update client.Update, reason string) {
+	t.Helper()
+
+	notice, err := update.Resync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if notice.Reason != reason {
+		t.Errorf("resync reason = %q, want %q", notice.Reason, reason)
+	}
+}
+
+// levels parses the levels of a snapshot in the order of the book.
+func levels(t *testing.T, snapshot [][]string) []client.Level {
+	t.Helper()
+
+	parsed := make([]client.Level, 0, len(snapshot))
+
+	for _, level := range snapshot {
+		price, err := strconv.ParseFloat(level[0], 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		qty, err := strconv.ParseFloat(level[1], 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parsed = append(parsed, client.Level{Price: price, Qty: qty})
+	}
+
+	return parsed
+}
+
+// fakeBook is the order book of the test symbol, updated by the test instead of the upstream.
+type fakeBook struct {
+	mu           sync.Mutex
+	bids         map[string]string
+	asks         map[string]string
+	lastUpdateId int
+}
+
+func newFakeBook() *fakeBook {
+	return &fakeBook{
+		bids:         map[string]string{"65000": "1", "64999": "2"},
+		asks:         map[string]string{"65001": "1.5", "65002": "0.5"},
+		lastUpdateId: 100,
+	}
+}
+
+// apply updates the levels and returns the delta message of the update, a zero quantity removing the level.
+func (b *fakeBook) apply(bids, asks map[string]string) *dtos.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	putLevels(b.bids, bids)
+	putLevels(b.asks, asks)
+
+	b.lastUpdateId++
+
+	event := &dtos.EventUpdate{
+		EventType:     "depthUpdate",
+		EventTime:     int(time.Now().UnixMilli()),
+		Symbol:        testSymbol,
+		FirstUpdateId: b.lastUpdateId,
+		FinalUpdateId: b.lastUpdateId,
+		Bids:          deltaLevels(bids),
+		Asks:          deltaLevels(asks),
+	}
+
+	return &dtos.Message{
+		Type:    dtos.TypeDelta,
+		Symbol:  testSymbol,
+		Seq:     b.lastUpdateId,
+		PrevSeq: b.lastUpdateId - 1,
+		Ts:      int64(event.EventTime),
+		Data:    event,
+	}
+}
+
+// snapshot returns the levels sorted in the order of the book.
+func (b *fakeBook) snapshot() *dtos.Snapshot {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return &dtos.Snapshot{
+		LastUpdateId: b.lastUpdateId,
+		Bids:         sortedLevels(b.bids, true),
+		Asks:         sortedLevels(b.asks, false),
+	}
+}
+
+func (b *fakeBook) GetOrderBook(curr string, _ int) (*dtos.Snapshot, error) {
+	if curr != testSymbol {
+		return nil, errNotServed
+	}
+
+	return b.snapshot(), nil
+}
+
+func (b *fakeBook) GetGroupedOrderBook(string, float64, int) (*dtos.Snapshot, error) {
+	return nil, errNotServed
+}
+
+func (b *fakeBook) GetBBO(string) (*dtos.BBO, int, error) {
+	return nil, 0, errNotServed
+}
+
+func (b *fakeBook) Symbols() []string {
+	return []string{testSymbol}
+}
+
+func (b *fakeBook) BookStatus(curr string) dtos.SymbolStatus {
+	return dtos.SymbolStatus{Symbol: curr, State: dtos.BookLive}
+}
+
+func (b *fakeBook) GetAnalytics(string) (*dtos.Message, error) {
+	return nil, errNotServed
+}
+
+func (b *fakeBook) GetImpact(string, dtos.Side, float64) (*dtos.Impact, int, error) {
+	return nil, 0, errNotServed
+}
+
+func putLevels(side, levels map[string]string) {
+	for price, qty := range levels {
+		if qty == "0" {
+			delete(side, price)
+		} else {
+			side[price] = qty
+		}
+	}
+}
+
+func deltaLevels(levels map[string]string) [][]string {
+	delta := [][]string{}
+
+	for _, price := range slices.Sorted(maps.Keys(levels)) {
+		delta = append(delta, []string{price, levels[price]})
+	}
+
+	return delta
+}
+
+// sortedLevels returns the levels of a side, the bids by descending price and the asks by ascending price.
+func sortedLevels(side map[string]string, descending bool) [][]string {
+	levels := deltaLevels(side)
+
+	slices.SortFunc(levels, func(a, b []string) int {
+		pa, _ := strconv.ParseFloat(a[0], 64)
+		pb, _ := strconv.ParseFloat(b[0], 64)
+
+		if descending {
+			return cmp.Compare(pb, pa)
+		}
+
+		return cmp.Compare(pa, pb)
+	})
+
+	return levels
+}
+
+// upstream reports a connected upstream to the health endpoints.
+type upstream struct{}
+
+func (upstream) IsConnected() bool {
+	return true
+}
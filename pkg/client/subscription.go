@@ -0,0 +1,284 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"ob-manager/internal/feed"
+	"ob-manager/pkg/protocol"
+)
+
+// Stream of a currency pair a subscription receives.
+type Stream = feed.Stream
+
+const (
+	// StreamDepth maintains the local order book of the currency pair.
+	StreamDepth = feed.Depth
+	// StreamBBO receives the best bid and ask when they change.
+	StreamBBO = feed.BBO
+	// StreamAnalytics receives the metrics derived from the order book after each update.
+	StreamAnalytics = feed.Analytics
+)
+
+const (
+	subscribe   = "SUB"
+	unsubscribe = "UNSUB"
+)
+
+// ErrSlowConsumer closes the channel subscriptions whose buffer is full.
+var ErrSlowConsumer = feed.ErrSlowConsumer
+
+// Options of a subscription, sent with the SUB command.
+type Options struct {
+	// Depth limits the depth stream to the best levels on each side.
+	Depth int
+	// Group aggregates the depth stream to price buckets of the given step.
+	Group float64
+	// Interval conflates the updates and publishes them at most once per interval.
+	Interval time.Duration
+}
+
+// Update is a message of the server delivered to a subscription, decoded with the protocol package.
+// The depth subscriptions get the snapshot, delta, status and resync messages of their book, and a resync
+// message when the client invalidates the book: with the "sequence gap" reason when a delta does not follow the
+// book, which is resubscribed, and with the "connection lost" reason before reconnecting.
+// The other subscriptions get the messages of their stream and the status and resync messages.
+type Update struct {
+	*protocol.Envelope
+
+	// Book is the local order book updated with the message, nil for the streams other than depth.
+	// For the channel subscriptions, the book may be ahead of the update when it is received.
+	Book *Book
+}
+
+type subscriptionKey struct {
+	symbol string
+	stream Stream
+}
+
+// Subscription receives the updates of a stream of a currency pair, kept across the reconnections.
+type Subscription struct {
+	client  *Client
+	key     subscriptionKey
+	options Options
+	book    *Book
+	sink    *feed.Sink[Update]
+}
+
+// Subscribe returns a subscription delivering the updates of a stream of a currency pair to its channel.
+// The subscription is closed when the subscriber does not keep up and its buffer is full.
+func (c *Client) Subscribe(symbol string, stream Stream, options Options) (*Subscription, error) {
+	return c.subscribe(symbol, stream, options, feed.NewChan[Update](c.cfg.Buffer))
+}
+
+// SubscribeFunc returns a subscription calling fn with the updates of a stream of a currency pair.
+// fn is called by the reader of the connection, so it must not block.
+func (c *Client) SubscribeFunc(symbol string, stream Stream, options Options, fn func(Update)) (*Subscription, error) {
+	return c.subscribe(symbol, stream, options, feed.NewFunc(fn))
+}
+
+func (c *Client) subscribe(symbol string, stream Stream, options Options, sink *feed.Sink[Update]) (*Subscription,
+	error) {
+	key := subscriptionKey{symbol: strings.ToUpper(symbol), stream: stream}
+
+	switch stream {
+	case StreamDepth:
+	case StreamBBO, StreamAnalytics:
+		if options.Depth > 0 || options.Group > 0 {
+			return nil, fmt.Errorf("depth and group are not supported by the %s stream", stream)
+		}
+	default:
+		return nil, fmt.Errorf("unknown stream %s", stream)
+	}
+
+	s := &Subscription{
+		client:  c,
+		key:     key,
+		options: options,
+		sink:    sink,
+	}
+
+	if stream == StreamDepth {
+		s.book = newBook(key.symbol)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stopped {
+		return nil, ErrClosed
+	}
+
+	if _, ok := c.subs[key]; ok {
+		return nil, fmt.Errorf("already subscribed to the %s stream of %s", stream, key.symbol)
+	}
+
+	c.subs[key] = s
+	c.sendCommand(s.command(subscribe))
+
+	return s, nil
+}
+
+// C returns the channel of the updates. It is closed with the subscription and nil for the callback subscriptions.
+func (s *Subscription) C() <-chan Update {
+	return s.sink.C()
+}
+
+// Symbol returns the currency pair of the subscription.
+func (s *Subscription) Symbol() string {
+	return s.key.symbol
+}
+
+// Stream returns the stream of the subscription.
+func (s *Subscription) Stream() Stream {
+	return s.key.stream
+}
+
+// Book returns the local order book of a depth subscription, nil for the other streams.
+func (s *Subscription) Book() *Book {
+	return s.book
+}
+
+// Close unsubscribes from the stream. A callback in progress may complete after Close returns.
+func (s *Subscription) Close() {
+	s.client.unsubscribe(s)
+	s.sink.Close(nil)
+}
+
+// Err returns why the subscription was closed: ErrSlowConsumer, ErrClosed or nil when it was closed by Close
+// or is still open.
+func (s *Subscription) Err() error {
+	return s.sink.Err()
+}
+
+// unsubscribe removes the subscription and unsubscribes from its stream.
+func (c *Client) unsubscribe(s *Subscription) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.subs[s.key] != s {
+		return
+	}
+
+	delete(c.subs, s.key)
+	c.sendCommand(s.command(unsubscribe))
+}
+
+// resubscribe sends the subscription again, so that the server sends a new snapshot.
+func (c *Client) resubscribe(s *Subscription) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.subs[s.key] == s {
+		c.sendCommand(s.command(subscribe))
+	}
+}
+
+// command returns the SUB or UNSUB command of the subscription.
+func (s *Subscription) command(method string) string {
+	args := []string{method, s.key.symbol, string(s.key.stream)}
+
+	if method == subscribe {
+		if s.options.Depth > 0 {
+			args = append(args, "depth="+strconv.Itoa(s.options.Depth))
+		}
+
+		if s.options.Group > 0 {
+			args = append(args, "group="+strconv.FormatFloat(s.options.Group, 'f', -1, 64))
+		}
+
+		if s.options.Interval > 0 {
+			args = append(args, "interval="+s.options.Interval.String())
+		}
+	}
+
+	return strings.Join(args, " ")
+}
+
+// handle updates the local order book with the message and delivers it.
+func (s *Subscription) handle(envelope *protocol.Envelope) {
+	switch envelope.Type {
+	case protocol.TypeSnapshot:
+		if s.book == nil {
+			return
+		}
+
+		snapshot, err := envelope.Snapshot()
+		if err == nil {
+			err = s.book.reset(snapshot)
+		}
+
+		if err != nil {
+			slog.Error("Error on Applying Snapshot, resubscribing.", "Currency", s.key.symbol, "Error", err)
+			s.book.invalidate()
+			s.client.resubscribe(s)
+
+			return
+		}
+	case protocol.TypeDelta:
+		if s.book == nil {
+			return
+		}
+
+		delta, err := envelope.Delta()
+		if err != nil {
+			slog.Error("Error on Decoding Delta", "Currency", s.key.symbol, "Error", err)
+
+			return
+		}
+
+		applied, err := s.book.apply(envelope.PrevSeq, delta)
+		if err != nil {
+			slog.Error("Error on Applying Delta, resubscribing.", "Currency", s.key.symbol, "Error", err)
+			s.book.invalidate()
+			s.deliver(resyncUpdate(envelope.Symbol, "sequence gap"))
+			s.client.resubscribe(s)
+
+			return
+		}
+
+		if !applied {
+			return
+		}
+	case protocol.TypeBBO, protocol.TypeAnalytics:
+		if string(s.key.stream) != string(envelope.Type) {
+			return
+		}
+	case protocol.TypeStatus:
+		if s.book != nil {
+			if status, err := envelope.Status(); err == nil {
+				s.book.setState(status.State)
+			}
+		}
+	case protocol.TypeResync:
+		if s.book != nil {
+			s.book.invalidate()
+		}
+	}
+
+	s.deliver(envelope)
+}
+
+// resyncUpdate returns the resync message of an order book invalidated by the client.
+func resyncUpdate(symbol, reason string) *protocol.Envelope {
+	data, _ := json.Marshal(protocol.ResyncNotice{Reason: reason})
+
+	return &protocol.Envelope{
+		Type:   protocol.TypeResync,
+		Symbol: symbol,
+		Ts:     time.Now().UnixMilli(),
+		Data:   data,
+	}
+}
+
+// deliver sends the update to the subscriber. A channel subscription whose buffer is full is closed.
+func (s *Subscription) deliver(envelope *protocol.Envelope) {
+	if err := s.sink.Deliver(Update{Envelope: envelope, Book: s.book}); err != nil {
+		slog.Error("Subscription buffer full, closing it.", "Currency", s.key.symbol, "Stream", s.key.stream)
+		s.client.unsubscribe(s)
+	}
+}
@@ -0,0 +1,310 @@
+// Package obmanager runs the order book engine in-process: the Binance depth streams are applied to local order
+// books, which are queried and subscribed to with Go values instead of the websocket protocol.
+//
+//	engine, err := obmanager.Start(obmanager.Config{Symbols: []string{"BTCUSDT"}})
+//	if err != nil {
+//		return err
+//	}
+//	defer engine.Stop()
+//
+//	sub, err := engine.Subscribe("BTCUSDT", obmanager.StreamDepth)
+//	for message := range sub.C() {
+//		...
+//	}
+package obmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"ob-manager/internal/dtos"
+	"ob-manager/internal/lifecycle"
+	"ob-manager/internal/processors"
+	"ob-manager/internal/queues"
+	"ob-manager/internal/upstream/binance"
+	"ob-manager/pkg/protocol"
+
+	inqueues "ob-manager/internal/queues/in"
+	outqueues "ob-manager/internal/queues/out"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Message is an update of an order book. Data is a *protocol.Snapshot for the snapshot messages,
+// a *protocol.Delta for the delta messages, and a protocol.BBO, protocol.Analytics, protocol.StatusNotice or
+// protocol.ResyncNotice for the messages of these types.
+type Message = dtos.Message
+
+// SymbolStatus is the sync state of the order book of a currency pair.
+type SymbolStatus = dtos.SymbolStatus
+
+var (
+	// ErrUnknownSymbol is returned for the currency pairs not maintained by the engine.
+	ErrUnknownSymbol = processors.ErrUnknownSymbol
+	// ErrNotSynced is returned while the order book is not synced with the upstream.
+	ErrNotSynced = processors.ErrNotSynced
+	// ErrStopped is returned when the engine is stopped.
+	ErrStopped = errors.New("engine stopped")
+)
+
+// Config of the engine. The zero values are replaced by the defaults of the service.
+type Config struct {
+	// Symbols are the currency pairs maintained by the engine.
+	Symbols []string
+	// StaleAfter is the maximum time without events of a live book. It defaults to 10s.
+	StaleAfter time.Duration
+	// MaxEventLag is the maximum delay between the event time and its reception. It defaults to 5s.
+	MaxEventLag time.Duration
+	// QueueSize is the number of events buffered for each currency pair and of updates buffered for the
+	// subscriptions. It defaults to 10000.
+	QueueSize int
+	// Buffer is the number of messages buffered for each channel subscription. It defaults to 1024.
+	Buffer int
+	// AnalyticsInterval is the minimum time between two analytics messages of a currency pair.
+	// It defaults to 100ms.
+	AnalyticsInterval time.Duration
+	// ImbalanceDepth is the number of levels on each side used for the order book imbalance. It defaults to 10.
+	ImbalanceDepth int
+	// DepthBands are the distances from the mid price in basis points of the cumulative notionals of the
+	// analytics. They default to 10, 25, 50 and 100.
+	DepthBands []float64
+}
+
+func (c Config) withDefaults() (Config, error) {
+	if len(c.Symbols) == 0 {
+		return c, fmt.Errorf("no symbol configured")
+	}
+
+	symbols := make([]string, 0, len(c.Symbols))
+	for _, symbol := range c.Symbols {
+		symbols = append(symbols, strings.ToUpper(strings.TrimSpace(symbol)))
+	}
+
+	c.Symbols = symbols
+
+	if c.StaleAfter <= 0 {
+		c.StaleAfter = 10 * time.Second
+	}
+
+	if c.MaxEventLag <= 0 {
+		c.MaxEventLag = 5 * time.Second
+	}
+
+	if c.QueueSize <= 0 {
+		c.QueueSize = 10000
+	}
+
+	if c.Buffer <= 0 {
+		c.Buffer = 1024
+	}
+
+	if c.AnalyticsInterval <= 0 {
+		c.AnalyticsInterval = 100 * time.Millisecond
+	}
+
+	if c.ImbalanceDepth <= 0 {
+		c.ImbalanceDepth = 10
+	}
+
+	if len(c.DepthBands) == 0 {
+		c.DepthBands = []float64{10, 25, 50, 100}
+	}
+
+	return c, nil
+}
+
+// Engine maintains the order books of the configured currency pairs.
+type Engine struct {
+	cfg        Config
+	procs      *processors.Manager
+	client     *binance.Client
+	dispatcher *dispatcher
+
+	group  *errgroup.Group
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	stopOnce sync.Once
+	err      error
+}
+
+// Start connects to the upstream and maintains the order books until Stop is called or a component fails.
+func Start(cfg Config) (*Engine, error) {
+	cfg, err := cfg.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	settings := queues.Settings{Size: cfg.QueueSize, Policy: queues.Block}
+
+	inQueue := inqueues.NewQManager(settings)
+	outQueue := outqueues.NewQueue(settings, 1)
+
+	procs := processors.NewManager(inQueue, outQueue, processors.StaleThresholds{
+		StaleAfter:  cfg.StaleAfter,
+		MaxEventLag: cfg.MaxEventLag,
+	}, processors.AnalyticsSettings{
+		Interval:       cfg.AnalyticsInterval,
+		ImbalanceDepth: cfg.ImbalanceDepth,
+		DepthBands:     cfg.DepthBands,
+	})
+
+	e := &Engine{
+		cfg:        cfg,
+		procs:      procs,
+		client:     binance.NewClient(make(chan []byte), inQueue, procs, cfg.Symbols),
+		dispatcher: newDispatcher(outQueue, procs),
+		done:       make(chan struct{}),
+	}
+
+	var ctx context.Context
+
+	ctx, e.cancel = context.WithCancel(context.Background())
+
+	g, gctx := errgroup.WithContext(ctx)
+	e.group = g
+
+	dispatcher := lifecycle.Start(g, "dispatcher", e.dispatcher)
+	processorsService := lifecycle.Start(g, "processors", procs)
+	upstream := lifecycle.Start(g, "upstream client", e.client)
+
+	// the upstream is closed first, so that the processors and the dispatcher do not block it
+	g.Go(func() error {
+		<-gctx.Done()
+		close(e.done)
+
+		upstream.Stop()
+		processorsService.Stop()
+		dispatcher.Stop()
+
+		return nil
+	})
+
+	return e, nil
+}
+
+// Stop closes the upstream connection, stops the order books and closes the subscriptions.
+// It returns the error of the component whose failure stopped the engine, if any.
+func (e *Engine) Stop() error {
+	e.stopOnce.Do(func() {
+		e.cancel()
+		e.err = e.group.Wait()
+	})
+
+	return e.err
+}
+
+// Done is closed when the engine stops, after Stop or the failure of a component.
+func (e *Engine) Done() <-chan struct{} {
+	return e.done
+}
+
+// Symbols returns the currency pairs maintained by the engine.
+func (e *Engine) Symbols() []string {
+	return slices.Clone(e.cfg.Symbols)
+}
+
+// Connected reports whether the upstream connection is up.
+func (e *Engine) Connected() bool {
+	return e.client.IsConnected()
+}
+
+// Snapshot returns the order book of a currency pair. A depth greater than 0 limits it to the best depth levels
+// on each side.
+func (e *Engine) Snapshot(symbol string, depth int) (*protocol.Snapshot, error) {
+	symbol, err := e.symbol(symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot, err := e.procs.GetOrderBook(symbol, depth)
+
+	return snapshot, bookError(err)
+}
+
+// GroupedSnapshot returns the order book of a currency pair aggregated to price buckets of the given step.
+// A depth greater than 0 limits it to the best depth buckets on each side.
+func (e *Engine) GroupedSnapshot(symbol string, step float64, depth int) (*protocol.Snapshot, error) {
+	symbol, err := e.symbol(symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot, err := e.procs.GetGroupedOrderBook(symbol, step, depth)
+
+	return snapshot, bookError(err)
+}
+
+// BBO returns the best bid and ask of a currency pair with the last update id of its order book.
+func (e *Engine) BBO(symbol string) (*protocol.BBO, int, error) {
+	symbol, err := e.symbol(symbol)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	bbo, lastUpdateId, err := e.procs.GetBBO(symbol)
+
+	return bbo, lastUpdateId, bookError(err)
+}
+
+// Analytics returns the latest analytics message of a currency pair. It is nil until the first update.
+func (e *Engine) Analytics(symbol string) (*Message, error) {
+	symbol, err := e.symbol(symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	analytics, err := e.procs.GetAnalytics(symbol)
+
+	return analytics, bookError(err)
+}
+
+// Impact estimates the fill of a market order of the given quantity against the order book of a currency pair.
+func (e *Engine) Impact(symbol string, side protocol.Side, qty float64) (*protocol.Impact, int, error) {
+	symbol, err := e.symbol(symbol)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	impact, lastUpdateId, err := e.procs.GetImpact(symbol, side, qty)
+
+	return impact, lastUpdateId, bookError(err)
+}
+
+// Status returns the sync state of the order book of a currency pair.
+func (e *Engine) Status(symbol string) (SymbolStatus, error) {
+	symbol, err := e.symbol(symbol)
+	if err != nil {
+		return SymbolStatus{}, err
+	}
+
+	status := e.procs.BookStatus(symbol)
+	status.Subscribers = e.dispatcher.count(symbol)
+
+	return status, nil
+}
+
+// symbol returns the upper case currency pair, or ErrUnknownSymbol if the engine does not maintain it.
+func (e *Engine) symbol(symbol string) (string, error) {
+	symbol = strings.ToUpper(symbol)
+	if !slices.Contains(e.cfg.Symbols, symbol) {
+		return "", ErrUnknownSymbol
+	}
+
+	return symbol, nil
+}
+
+// bookError returns the error of the order book of a configured currency pair. A currency pair without a
+// processor is not synced: the processors are started once the upstream is connected and reset when it reconnects.
+func bookError(err error) error {
+	if errors.Is(err, processors.ErrUnknownSymbol) {
+		return ErrNotSynced
+	}
+
+	return err
+}
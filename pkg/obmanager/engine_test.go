@@ -0,0 +1,193 @@
+package obmanager
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"ob-manager/pkg/protocol"
+)
+
+// stopTimeout bounds the stop of the engine, which waits for the upstream client to close its connection.
+const stopTimeout = 10 * time.Second
+
+func TestMain(m *testing.M) {
+	// the upstream connection attempts are logged
+	slog.SetDefault(slog.New(slog.DiscardHandler))
+
+	os.Exit(m.Run())
+}
+
+func TestConfigDefaults(t *testing.T) {
+	cfg, err := Config{Symbols: []string{" btcusdt", "EthUsdt "}}.withDefaults()
+	if err != nil {
+		t.Fatalf("withDefaults() error = %v", err)
+	}
+
+	want := Config{
+		Symbols:           []string{"BTCUSDT", "ETHUSDT"},
+		StaleAfter:        10 * time.Second,
+		MaxEventLag:       5 * time.Second,
+		QueueSize:         10000,
+		Buffer:            1024,
+		AnalyticsInterval: 100 * time.Millisecond,
+		ImbalanceDepth:    10,
+		DepthBands:        []float64{10, 25, 50, 100},
+	}
+
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("withDefaults() = %+v, want %+v", cfg, want)
+	}
+
+	set := Config{Symbols: []string{"BTCUSDT"}, Buffer: 8, AnalyticsInterval: time.Second, DepthBands: []float64{5}}
+
+	cfg, err = set.withDefaults()
+	if err != nil {
+		t.Fatalf("withDefaults() error = %v", err)
+	}
+
+	if cfg.Buffer != 8 || cfg.AnalyticsInterval != time.Second || !slices.Equal(cfg.DepthBands, []float64{5}) {
+		t.Errorf("withDefaults() = %+v, want the values set kept", cfg)
+	}
+
+	if _, err := (Config{}).withDefaults(); err == nil {
+		t.Error("withDefaults() error = nil, want an error without symbols")
+	}
+}
+
+// TestBookErrors checks the errors of the queries before the order books are synced: the engine dials the
+// upstream when it starts, so its books cannot be synced yet.
+func TestBookErrors(t *testing.T) {
+	e := startEngine(t)
+
+	for _, tt := range []struct {
+		symbol string
+		want   error
+	}{
+		{symbol: "btcusdt", want: ErrNotSynced},
+		{symbol: "DOGEUSDT", want: ErrUnknownSymbol},
+	} {
+		queries := map[string]error{}
+
+		_, queries["Snapshot"] = e.Snapshot(tt.symbol, 0)
+		_, queries["GroupedSnapshot"] = e.GroupedSnapshot(tt.symbol, 10, 0)
+		_, _, queries["BBO"] = e.BBO(tt.symbol)
+		_, queries["Analytics"] = e.Analytics(tt.symbol)
+		_, _, queries["Impact"] = e.Impact(tt.symbol, protocol.SideBuy, 1)
+
+		for query, err := range queries {
+			if !errors.Is(err, tt.want) {
+				t.Errorf("%s(%q) error = %v, want %v", query, tt.symbol, err, tt.want)
+			}
+		}
+	}
+
+	status, err := e.Status("btcusdt")
+	if err != nil || status.Symbol != "BTCUSDT" || status.State != protocol.BookSyncing {
+		t.Errorf("Status() = %+v, %v, want the syncing BTCUSDT book", status, err)
+	}
+
+	if _, err := e.Status("DOGEUSDT"); !errors.Is(err, ErrUnknownSymbol) {
+		t.Errorf("Status() error = %v, want %v", err, ErrUnknownSymbol)
+	}
+
+	if _, err := e.Subscribe("DOGEUSDT", StreamDepth); !errors.Is(err, ErrUnknownSymbol) {
+		t.Errorf("Subscribe() error = %v, want %v", err, ErrUnknownSymbol)
+	}
+
+	if _, err := e.Subscribe("BTCUSDT", "trades"); err == nil {
+		t.Error("Subscribe() error = nil, want an unknown stream")
+	}
+}
+
+// TestSubscriptionLifecycle checks that the subscriptions are counted until closed, and closed with ErrStopped
+// when the engine stops.
+func TestSubscriptionLifecycle(t *testing.T) {
+	e := startEngine(t)
+
+	depth, err := e.Subscribe("btcusdt", StreamDepth)
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+
+	bbo, err := e.SubscribeFunc("BTCUSDT", StreamBBO, func(*Message) {})
+	if err != nil {
+		t.Fatalf("SubscribeFunc() error = %v", err)
+	}
+
+	closed, err := e.Subscribe("BTCUSDT", StreamAnalytics)
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+
+	closed.Close()
+
+	if _, ok := <-closed.C(); ok || closed.Err() != nil {
+		t.Errorf("closed subscription open or Err() = %v, want closed with nil", closed.Err())
+	}
+
+	if status, _ := e.Status("BTCUSDT"); status.Subscribers != 2 {
+		t.Errorf("Subscribers = %d, want 2", status.Subscribers)
+	}
+
+	stopEngine(t, e)
+
+	select {
+	case <-e.Done():
+	default:
+		t.Error("Done() not closed after Stop")
+	}
+
+	// the channel is closed once the messages delivered before the stop are read
+	for range depth.C() {
+	}
+
+	for _, s := range []*Subscription{depth, bbo} {
+		if !errors.Is(s.Err(), ErrStopped) {
+			t.Errorf("%s subscription Err() = %v, want %v", s.Stream(), s.Err(), ErrStopped)
+		}
+	}
+
+	if _, err := e.Subscribe("BTCUSDT", StreamDepth); !errors.Is(err, ErrStopped) {
+		t.Errorf("Subscribe() after Stop error = %v, want %v", err, ErrStopped)
+	}
+
+	if err := e.Stop(); err != nil {
+		t.Errorf("second Stop() error = %v, want nil", err)
+	}
+}
+
+// startEngine starts an engine of the BTCUSDT and ETHUSDT books, stopped at the end of the test.
+func startEngine(t *testing.T) *Engine {
+	t.Helper()
+
+	e, err := Start(Config{Symbols: []string{"BTCUSDT", "ETHUSDT"}})
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	t.Cleanup(func() { stopEngine(t, e) })
+
+	return e
+}
+
+func stopEngine(t *testing.T, e *Engine) {
+	t.Helper()
+
+	stopped := make(chan error, 1)
+
+	go func() { stopped <- e.Stop() }()
+
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("Stop() error = %v", err)
+		}
+	case <-time.After(stopTimeout):
+		t.Fatal("engine not stopped")
+	}
+}
@@ -0,0 +1,277 @@
+package obmanager
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"ob-manager/internal/dtos"
+	"ob-manager/internal/feed"
+	"ob-manager/internal/processors"
+
+	outqueues "ob-manager/internal/queues/out"
+)
+
+// Stream of a currency pair a subscription receives.
+type Stream = feed.Stream
+
+const (
+	// StreamDepth receives a snapshot of the full order book, then its deltas. A resync message is followed by
+	// a new snapshot.
+	StreamDepth = feed.Depth
+	// StreamBBO receives the best bid and ask when they change.
+	StreamBBO = feed.BBO
+	// StreamAnalytics receives the metrics derived from the order book after each update.
+	StreamAnalytics = feed.Analytics
+)
+
+// ErrSlowConsumer closes the channel subscriptions whose buffer is full.
+var ErrSlowConsumer = feed.ErrSlowConsumer
+
+// streamTypes are the message types of the state streams.
+var streamTypes = map[dtos.MessageType]Stream{
+	dtos.TypeBBO:       StreamBBO,
+	dtos.TypeAnalytics: StreamAnalytics,
+}
+
+// Subscription receives the updates of a stream of a currency pair, with the status and resync messages of its
+// order book. The messages of a currency pair are delivered in order by a single go routine.
+type Subscription struct {
+	symbol     string
+	stream     Stream
+	dispatcher *dispatcher
+	sink       *feed.Sink[*Message]
+
+	// lastUpdateId is the Seq of the last message delivered. It is only used by the dispatcher.
+	lastUpdateId int
+}
+
+// Subscribe returns a subscription delivering the messages of a stream of a currency pair to its channel.
+// The subscription is closed when the subscriber does not keep up and its buffer is full.
+func (e *Engine) Subscribe(symbol string, stream Stream) (*Subscription, error) {
+	return e.subscribe(symbol, stream, feed.NewChan[*Message](e.cfg.Buffer))
+}
+
+// SubscribeFunc returns a subscription calling fn with the messages of a stream of a currency pair.
+// fn is called by the go routine delivering the messages of the currency pair, so it must not block.
+func (e *Engine) SubscribeFunc(symbol string, stream Stream, fn func(*Message)) (*Subscription, error) {
+	return e.subscribe(symbol, stream, feed.NewFunc(fn))
+}
+
+func (e *Engine) subscribe(symbol string, stream Stream, sink *feed.Sink[*Message]) (*Subscription, error) {
+	symbol, err := e.symbol(symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	switch stream {
+	case StreamDepth, StreamBBO, StreamAnalytics:
+	default:
+		return nil, errors.New("unknown stream " + string(stream))
+	}
+
+	s := &Subscription{
+		symbol:     symbol,
+		stream:     stream,
+		dispatcher: e.dispatcher,
+		sink:       sink,
+	}
+
+	if !e.dispatcher.add(s) {
+		return nil, ErrStopped
+	}
+
+	return s, nil
+}
+
+// C returns the channel of the messages. It is closed with the subscription and nil for the callback subscriptions.
+func (s *Subscription) C() <-chan *Message {
+	return s.sink.C()
+}
+
+// Symbol returns the currency pair of the subscription.
+func (s *Subscription) Symbol() string {
+	return s.symbol
+}
+
+// Stream returns the stream of the subscription.
+func (s *Subscription) Stream() Stream {
+	return s.stream
+}
+
+// Close stops the delivery of the messages. A callback in progress may complete after Close returns.
+func (s *Subscription) Close() {
+	s.dispatcher.remove(s)
+	s.sink.Close(nil)
+}
+
+// Err returns why the subscription was closed: ErrSlowConsumer, ErrStopped or nil when it was closed by Close
+// or is still open.
+func (s *Subscription) Err() error {
+	return s.sink.Err()
+}
+
+// deliver sends the message to the subscriber. A channel subscription whose buffer is full is closed.
+func (s *Subscription) deliver(message *Message) {
+	if err := s.sink.Deliver(message); err != nil {
+		slog.Error("Subscription buffer full, closing it.", "Currency", s.symbol, "Stream", s.stream)
+		s.dispatcher.remove(s)
+	}
+}
+
+// dispatcher delivers the messages of the out-queue to the subscriptions.
+type dispatcher struct {
+	outQ  *outqueues.Queue
+	procs *processors.Manager
+
+	mu      sync.RWMutex
+	stopped bool
+	subs    map[string][]*Subscription
+}
+
+func newDispatcher(outQ *outqueues.Queue, procs *processors.Manager) *dispatcher {
+	return &dispatcher{
+		outQ:  outQ,
+		procs: procs,
+		subs:  make(map[string][]*Subscription),
+	}
+}
+
+// Run delivers the messages until the context is done, then closes the subscriptions with ErrStopped.
+func (d *dispatcher) Run(ctx context.Context) error {
+	var workers sync.WaitGroup
+
+	for _, outQ := range d.outQ.OutQs() {
+		workers.Go(func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case message := <-outQ:
+					d.dispatch(message)
+				}
+			}
+		})
+	}
+
+	workers.Wait()
+
+	d.mu.Lock()
+	d.stopped = true
+	subs := d.subs
+	d.subs = nil
+	d.mu.Unlock()
+
+	for _, symbolSubs := range subs {
+		for _, s := range symbolSubs {
+			s.sink.Close(ErrStopped)
+		}
+	}
+
+	return nil
+}
+
+// add registers the subscription. It returns false when the dispatcher is stopped.
+func (d *dispatcher) add(s *Subscription) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.stopped {
+		return false
+	}
+
+	// the slices are replaced, so that the dispatch iterates without the lock
+	d.subs[s.symbol] = append(slices.Clip(d.subs[s.symbol]), s)
+
+	return true
+}
+
+func (d *dispatcher) remove(s *Subscription) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.stopped {
+		return
+	}
+
+	subs := slices.DeleteFunc(slices.Clone(d.subs[s.symbol]), func(sub *Subscription) bool {
+		return sub == s
+	})
+
+	if len(subs) == 0 {
+		delete(d.subs, s.symbol)
+	} else {
+		d.subs[s.symbol] = subs
+	}
+}
+
+func (d *dispatcher) count(symbol string) int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return len(d.subs[symbol])
+}
+
+// dispatch delivers a message to the subscriptions of its currency pair. The depth subscriptions get a snapshot
+// before their first delta and after a resync.
+func (d *dispatcher) dispatch(message *Message) {
+	d.mu.RLock()
+	subs := d.subs[message.Symbol]
+	d.mu.RUnlock()
+
+	for _, s := range subs {
+		switch message.Type {
+		case dtos.TypeDelta:
+			if s.stream != StreamDepth {
+				continue
+			}
+
+			if s.lastUpdateId == 0 {
+				// without the snapshot the delta cannot be applied, the snapshot is retried with the next one
+				if s.lastUpdateId = d.sendSnapshot(s); s.lastUpdateId == 0 {
+					continue
+				}
+			}
+
+			if message.Seq <= s.lastUpdateId {
+				continue
+			}
+
+			s.lastUpdateId = message.Seq
+		case dtos.TypeBBO, dtos.TypeAnalytics:
+			if s.stream != streamTypes[message.Type] || message.Seq <= s.lastUpdateId {
+				continue
+			}
+
+			s.lastUpdateId = message.Seq
+		case dtos.TypeResync:
+			s.lastUpdateId = 0
+		}
+
+		s.deliver(message)
+	}
+}
+
+// sendSnapshot delivers the order book to the subscription and returns its last update id.
+// It returns 0 when the order book is not synced, so that the snapshot is sent with the next delta.
+func (d *dispatcher) sendSnapshot(s *Subscription) int {
+	snapshot, err := d.procs.GetOrderBook(s.symbol, 0)
+	if err != nil {
+		slog.Error("error on getting order book", "Currency", s.symbol, "Error", err)
+
+		return 0
+	}
+
+	s.deliver(&Message{
+		Type:   dtos.TypeSnapshot,
+		Symbol: s.symbol,
+		Seq:    snapshot.LastUpdateId,
+		Ts:     time.Now().UnixMilli(),
+		Data:   snapshot,
+	})
+
+	return snapshot.LastUpdateId
+}
@@ -0,0 +1,148 @@
+// Package protocol decodes the messages sent by the OBManager websocket server.
+// The message schema is published in api/downstream.schema.json.
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"ob-manager/internal/dtos"
+)
+
+type (
+	MessageType     = dtos.MessageType
+	Snapshot        = dtos.Snapshot
+	Delta           = dtos.EventUpdate
+	BBO             = dtos.BBO
+	Analytics       = dtos.Analytics
+	DepthAtBps      = dtos.DepthAtBps
+	Impact          = dtos.Impact
+	Side            = dtos.Side
+	StatusNotice    = dtos.StatusNotice
+	BookState       = dtos.BookState
+	SubscriptionAck = dtos.SubscriptionAck
+	ResyncNotice    = dtos.ResyncNotice
+	ErrorMessage    = dtos.ErrorMessage
+	ServiceStatus   = dtos.ServiceStatus
+	SymbolStatus    = dtos.SymbolStatus
+)
+
+const (
+	TypeSnapshot     = dtos.TypeSnapshot
+	TypeDelta        = dtos.TypeDelta
+	TypeResync       = dtos.TypeResync
+	TypeSubscribed   = dtos.TypeSubscribed
+	TypeUnsubscribed = dtos.TypeUnsubscribed
+	TypeError        = dtos.TypeError
+	TypeHeartbeat    = dtos.TypeHeartbeat
+	TypeBBO          = dtos.TypeBBO
+	TypeAnalytics    = dtos.TypeAnalytics
+	TypeImpact       = dtos.TypeImpact
+	TypeStatus       = dtos.TypeStatus
+
+	SideBuy  = dtos.SideBuy
+	SideSell = dtos.SideSell
+
+	BookSyncing       = dtos.BookSyncing
+	BookLive          = dtos.BookLive
+	BookStale         = dtos.BookStale
+	BookOutOfSequence = dtos.BookOutOfSequence
+
+	ErrCodeBadRequest     = dtos.ErrCodeBadRequest
+	ErrCodeUnknownCommand = dtos.ErrCodeUnknownCommand
+	ErrCodeUnknownSymbol  = dtos.ErrCodeUnknownSymbol
+	ErrCodeNotSynced      = dtos.ErrCodeNotSynced
+	ErrCodeInternal       = dtos.ErrCodeInternal
+	ErrCodeUnauthorized   = dtos.ErrCodeUnauthorized
+	ErrCodeForbidden      = dtos.ErrCodeForbidden
+	ErrCodeLimitExceeded  = dtos.ErrCodeLimitExceeded
+	ErrCodeRateLimited    = dtos.ErrCodeRateLimited
+)
+
+// Envelope is a decoded message. Data is kept raw until the payload is requested for the message type.
+type Envelope struct {
+	Type    MessageType     `json:"type"`
+	Symbol  string          `json:"symbol,omitempty"`
+	Seq     int             `json:"seq,omitempty"`
+	PrevSeq int             `json:"prevSeq,omitempty"`
+	Ts      int64           `json:"ts"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// Decode parses a message received from the server.
+func Decode(message []byte) (*Envelope, error) {
+	var env Envelope
+
+	if err := json.Unmarshal(message, &env); err != nil {
+		return nil, err
+	}
+
+	if env.Type == "" {
+		return nil, fmt.Errorf("message type is missing")
+	}
+
+	return &env, nil
+}
+
+// Snapshot returns the payload of a snapshot message.
+func (e *Envelope) Snapshot() (*Snapshot, error) {
+	return decodeData[Snapshot](e, TypeSnapshot)
+}
+
+// Delta returns the payload of a delta message.
+func (e *Envelope) Delta() (*Delta, error) {
+	return decodeData[Delta](e, TypeDelta)
+}
+
+// BBO returns the payload of a bbo message.
+func (e *Envelope) BBO() (*BBO, error) {
+	return decodeData[BBO](e, TypeBBO)
+}
+
+// Analytics returns the payload of an analytics message.
+func (e *Envelope) Analytics() (*Analytics, error) {
+	return decodeData[Analytics](e, TypeAnalytics)
+}
+
+// Impact returns the payload of an impact message.
+func (e *Envelope) Impact() (*Impact, error) {
+	return decodeData[Impact](e, TypeImpact)
+}
+
+// Status returns the payload of a status message.
+func (e *Envelope) Status() (*StatusNotice, error) {
+	return decodeData[StatusNotice](e, TypeStatus)
+}
+
+// Resync returns the payload of a resync message.
+func (e *Envelope) Resync() (*ResyncNotice, error) {
+	return decodeData[ResyncNotice](e, TypeResync)
+}
+
+// Ack returns the payload of a subscribed or unsubscribed message.
+func (e *Envelope) Ack() (*SubscriptionAck, error) {
+	if e.Type == TypeUnsubscribed {
+		return decodeData[SubscriptionAck](e, TypeUnsubscribed)
+	}
+
+	return decodeData[SubscriptionAck](e, TypeSubscribed)
+}
+
+// Error returns the payload of an error message.
+func (e *Envelope) Error() (*ErrorMessage, error) {
+	return decodeData[ErrorMessage](e, TypeError)
+}
+
+func decodeData[T any](e *Envelope, msgType MessageType) (*T, error) {
+	if e.Type != msgType {
+		return nil, fmt.Errorf("message type is %s, not %s", e.Type, msgType)
+	}
+
+	var data T
+
+	if err := json.Unmarshal(e.Data, &data); err != nil {
+		return nil, fmt.Errorf("error on parsing %s payload: %w", msgType, err)
+	}
+
+	return &data, nil
+}